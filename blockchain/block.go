@@ -2,48 +2,117 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"fmt"
 	"log"
 	"time"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
 )
 
-//  Block structure inside of blockchain
-type Block struct {
-	Timestamp     int64
-	Transactions  []*Transaction
+// BlockVersion is the header version of blocks produced by this node
+const BlockVersion = 1
+
+// BlockHeader holds everything the proof of work commits to
+type BlockHeader struct {
+	Version       int
+	Height        int
 	PrevBlockHash []byte
-	Hash          []byte
-	Nonce         int
+	MerkleRoot    []byte
+	WitnessRoot   []byte
+	Timestamp     int64
+	Bits          uint32
+	Nonce         uint32
 }
 
-func GenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{})
+// Block structure inside of blockchain
+type Block struct {
+	BlockHeader
+	Transactions []*Transaction
+	Hash         []byte
 }
 
+func GenesisBlock(coinbase *Transaction, params *chaincfg.ChainParams) *Block {
+	block := newBlock(params.GenesisTimestamp, []*Transaction{coinbase}, []byte{}, 0, params.PowLimitBits)
+	HandleErr(NewProofOfWork(block).Run(context.Background()))
+
+	return block
+}
+
+// HashTransactions returns the Merkle root of the transaction IDs, which
+// leave out the unlocking scripts
 func (b *Block) HashTransactions() []byte {
 	var txHashes [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		txHashes = append(txHashes, tx.Hash())
 	}
 	tree := NewMerkleTree(txHashes)
 
 	return tree.RootNode.Data
 }
 
-// Function for cleating a new block, doing PoW inside a function
-func NewBlock(txs []*Transaction, prevBlockHash []byte) (b *Block) {
-	block := &Block{time.Now().Unix(), txs, prevBlockHash, []byte{}, 0}
+// HashWitnesses returns the Merkle root of the witness hashes of the
+// transactions, which commits the block to their unlocking scripts
+func (b *Block) HashWitnesses() []byte {
+	var witnessHashes [][]byte
+
+	for _, tx := range b.Transactions {
+		witnessHashes = append(witnessHashes, tx.WitnessHash())
+	}
+	tree := NewMerkleTree(witnessHashes)
+
+	return tree.RootNode.Data
+}
+
+// MerkleProof returns the proof that the transaction txID is committed to by
+// the Merkle root of the block. Its leaf is the transaction ID.
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	var txs [][]byte
+	index := -1
+
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		txs = append(txs, tx.Hash())
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("%w: %x in block %x", ErrTxNotFound, txID, b.Hash)
+	}
 
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+	return NewMerkleProof(txs, index)
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+func newBlock(timestamp int64, txs []*Transaction, prevBlockHash []byte, height int, bits uint32) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:       BlockVersion,
+			Height:        height,
+			PrevBlockHash: prevBlockHash,
+			Timestamp:     timestamp,
+			Bits:          bits,
+		},
+		Transactions: txs,
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.WitnessRoot = block.HashWitnesses()
 
 	return block
 }
 
+// Function for cleating a new block, doing PoW inside a function
+func NewBlock(txs []*Transaction, prevBlockHash []byte, height int, bits uint32) (b *Block) {
+	block := newBlock(time.Now().Unix(), txs, prevBlockHash, height, bits)
+	HandleErr(NewProofOfWork(block).Run(context.Background()))
+
+	return block
+}
+
+// HandleErr panics on errors that can only come from programming mistakes,
+// such as failing to gob-encode a value into memory or a cancelled
+// context.Background().
 func HandleErr(err error) {
 	if err != nil {
 		log.Panic(err)
@@ -59,11 +128,12 @@ func (b *Block) Serialize() []byte {
 	return res.Bytes()
 }
 
-func Deserialize(data []byte) *Block {
+func Deserialize(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&block)
-	HandleErr(err)
+	if err := decoder.Decode(&block); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
 
-	return &block
+	return &block, nil
 }
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+func TestBlockWitnessRoot(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := NewTransaction(alice, addressOn(chain, wallet.CreateWallet()), 20, Fee{}, PaymentLock{}, &UTXOSet{chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced.Inputs[0].UnlockingScript = reencodePushes(t, tx.Inputs[0].UnlockingScript)
+	coinbase, err := CoinbaseTx(addressOn(chain, alice), "", 1, 0, chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		block func() *Block
+	}{
+		{"witness replaced after mining", func() *Block {
+			block := solveBlock(t, chain, genesis, coinbase, tx)
+			block.Transactions = []*Transaction{coinbase, replaced}
+			return block
+		}},
+		{"witness root changed and mined", func() *Block {
+			block := solveBlock(t, chain, genesis, coinbase, tx)
+			block.WitnessRoot = newBlock(block.Timestamp, []*Transaction{coinbase, replaced}, nil, 0, 0).WitnessRoot
+			if err := NewProofOfWork(block).Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			return block
+		}},
+	}
+	for _, tt := range tests {
+		block := tt.block()
+		if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+			t.Fatalf("%s: merkle root no longer matches, the witness root is not what is tested", tt.name)
+		}
+		err := chain.ProcessBlock(block)
+		if !errors.Is(err, ErrInvalidBlock) || !strings.Contains(err.Error(), "witness root") {
+			t.Errorf("%s: got %v, want a witness root mismatch", tt.name, err)
+		}
+	}
+	if !bytes.Equal(chain.LastHash, genesis.Hash) {
+		t.Fatalf("tip moved to %x", chain.LastHash)
+	}
+
+	// The replaced witness, committed to, is accepted under the same ID
+	block := solveBlock(t, chain, genesis, coinbase, replaced)
+	if err := chain.ProcessBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	confirmed, err := chain.FindTransaction(tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(confirmed.WitnessHash(), replaced.WitnessHash()) {
+		t.Errorf("confirmed transaction has witness hash %x, want %x", confirmed.WitnessHash(), replaced.WitnessHash())
+	}
+}
@@ -1,27 +1,31 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"os"
-	"runtime"
+	"path/filepath"
+	"time"
 
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
 	badger "github.com/dgraph-io/badger"
 )
 
 const (
-	dbPath      = "./tmp/blocks"
-	dbFile      = "./tmp/blocks/MANIFEST"
-	genesisData = "Genesis block"
+	dbDir  = "blocks"
+	dbFile = "MANIFEST"
 )
 
 // Blockchain structure contains hash of last block and whole database
 type Blockchain struct {
 	LastHash []byte
 	Database *badger.DB
+	Params   *chaincfg.ChainParams
+
+	mempool *Mempool
 }
 
 // BlockchainIterator helps to get previous blocks
@@ -30,104 +34,282 @@ type BlockchainIterator struct {
 	Database    *badger.DB
 }
 
-// AddBlock function adds one more block into blockchain
-func (chain *Blockchain) AddBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
+// dbVersion is the current database layout. Version 1 databases, which have
+// no version key, store one UTXO entry per transaction instead of one per
+// output. Version 2 databases hold transactions from before locking scripts
+// and version 3 databases signatures without a hash type. Version 4 databases
+// use transaction IDs covering the unlocking scripts. All of them are rebuilt
+// from their blocks by migrate when opened.
+const dbVersion = 5
+
+var (
+	lastHashKey  = []byte("lh")
+	heightPrefix = []byte("h-")
+	versionKey   = []byte("dbversion")
+)
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleErr(err)
-		lastHash, err = item.Value()
+// heightKey is the key of the height index entry pointing at the main chain
+// block with the given height
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+
+	return key
+}
+
+// AddBlock mines a block with the given transactions on top of the tip and
+// connects it
+func (chain *Blockchain) AddBlock(transactions []*Transaction) (*Block, error) {
+	return chain.MineBlock(context.Background(), transactions, nil)
+}
 
+// MineBlock mines a block with the given transactions on top of the tip using
+// every CPU and connects it. Mining stops with ctx.Err() when ctx is
+// cancelled, for example because another block became the tip. Our own
+// blocks only contain transactions we built and signed, so their signatures
+// are not checked again.
+func (chain *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction, progress func(MiningProgress)) (*Block, error) {
+	var bits uint32
+	var minTimestamp int64
+
+	tip, err := chain.GetBlockNode(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		if bits, err = chain.calcNextRequiredBits(txn, tip); err != nil {
+			return err
+		}
+		minTimestamp, err = medianTimePast(txn, tip)
+		minTimestamp++
 		return err
 	})
-	HandleErr(err)
+	if err != nil {
+		return nil, err
+	}
 
-	newBlock := NewBlock(transactions, lastHash)
+	timestamp := time.Now().Unix()
+	if timestamp < minTimestamp {
+		timestamp = minTimestamp
+	}
+	newBlock := newBlock(timestamp, transactions, tip.Hash, tip.Height+1, bits)
+	pow := NewProofOfWork(newBlock)
+	pow.Progress = progress
+	if err := pow.Run(ctx); err != nil {
+		return nil, err
+	}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		HandleErr(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	if err := chain.ProcessBlock(newBlock); err != nil {
+		return nil, err
+	}
 
-		chain.LastHash = newBlock.Hash
+	return newBlock, nil
+}
 
+// GetBlockByHash returns the stored block with the given hash
+func (chain *Blockchain) GetBlockByHash(hash []byte) (*Block, error) {
+	var block *Block
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		block, err = getBlock(txn, hash)
 		return err
 	})
-	HandleErr(err)
 
-	return newBlock
+	return block, err
+}
+
+func getBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	item, err := txn.Get(hash)
+	if err == badger.ErrKeyNotFound {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	} else if err != nil {
+		return nil, err
+	}
+	encodedBlock, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return Deserialize(encodedBlock)
+}
+
+// GetBlockByHeight returns the main chain block with the given height
+func (chain *Blockchain) GetBlockByHeight(height int) (*Block, error) {
+	hashes, err := chain.GetBlockHashes(height, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.GetBlockByHash(hashes[0])
+}
+
+// GetBestHeight returns the height of the chain tip
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	tip, err := chain.GetBlockByHash(chain.LastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return tip.Height, nil
+}
+
+// GetBlockHashes returns the hashes of the main chain blocks with heights
+// from through to, inclusive
+func (chain *Blockchain) GetBlockHashes(from, to int) ([][]byte, error) {
+	var hashes [][]byte
+
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid height range %d-%d", from, to)
+	}
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		for height := from; height <= to; height++ {
+			item, err := txn.Get(heightKey(height))
+			if err == badger.ErrKeyNotFound {
+				return fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+			} else if err != nil {
+				return err
+			}
+			hash, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+
+	return hashes, err
 }
 
-func DBexist() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+func dbPath(params *chaincfg.ChainParams) string {
+	return filepath.Join(params.DataDir, dbDir)
+}
+
+func DBexist(params *chaincfg.ChainParams) bool {
+	if _, err := os.Stat(filepath.Join(dbPath(params), dbFile)); os.IsNotExist(err) {
 		return false
 	}
 
 	return true
 }
 
-func InitBlockchain(address string) *Blockchain {
+func openDB(params *chaincfg.ChainParams) (*badger.DB, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dbPath(params)
+	opts.ValueDir = dbPath(params)
+
+	return badger.Open(opts)
+}
+
+func InitBlockchain(address string, params *chaincfg.ChainParams) (*Blockchain, error) {
 	var lastHash []byte
 
-	if DBexist() {
-		fmt.Println("Blockchain already exist")
-		runtime.Goexit()
+	if DBexist(params) {
+		return nil, ErrChainExists
 	}
 
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
-
-	db, err := badger.Open(opts)
-	HandleErr(err)
+	db, err := openDB(params)
+	if err != nil {
+		return nil, err
+	}
 
 	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := GenesisBlock(cbtx)
-		fmt.Println("Genesis created")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		HandleErr(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
-
+		cbtx, err := CoinbaseTx(address, params.GenesisMessage, 0, 0, params)
+		if err != nil {
+			return err
+		}
+		genesis := GenesisBlock(cbtx, params)
 		lastHash = genesis.Hash
 
-		return err
-	})
+		node := &BlockNode{
+			Hash:      genesis.Hash,
+			Height:    0,
+			Bits:      genesis.Bits,
+			Timestamp: genesis.Timestamp,
+			ChainWork: CalcWork(genesis.Bits),
+		}
+		if err := txn.Set(genesis.Hash, genesis.Serialize()); err != nil {
+			return err
+		}
+		if err := putBlockNode(txn, node); err != nil {
+			return err
+		}
+		if err := setDBVersion(txn, dbVersion); err != nil {
+			return err
+		}
 
-	HandleErr(err)
+		return connectBlock(txn, genesis)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	chain := Blockchain{lastHash, db}
-	return &chain
+	chain := Blockchain{LastHash: lastHash, Database: db, Params: params}
+	return &chain, nil
 }
 
-func ContinueBlockchain(address string) *Blockchain {
-
-	if DBexist() == false {
-		fmt.Println("No one blockchain found, create a new one!")
-		runtime.Goexit()
+func ContinueBlockchain(params *chaincfg.ChainParams) (*Blockchain, error) {
+	if DBexist(params) == false {
+		return nil, ErrNoChain
 	}
 
 	var lastHash []byte
 
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
-
-	db, err := badger.Open(opts)
-	HandleErr(err)
+	db, err := openDB(params)
+	if err != nil {
+		return nil, err
+	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleErr(err)
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(lastHashKey)
+		if err == badger.ErrKeyNotFound {
+			return ErrNoChain
+		} else if err != nil {
+			return err
+		}
 
 		lastHash, err = item.Value()
 		return err
 	})
-	HandleErr(err)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	chain := Blockchain{LastHash: lastHash, Database: db, Params: params}
+	if err := chain.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &chain, nil
+}
+
+func getDBVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(versionKey)
+	if err == badger.ErrKeyNotFound {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return 0, err
+	}
 
-	chain := Blockchain{lastHash, db}
-	return &chain
+	return int(binary.BigEndian.Uint32(v)), nil
+}
+
+func setDBVersion(txn *badger.Txn, version int) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(version))
+
+	return txn.Set(versionKey, v)
 }
 
 // Iterator - parser of blockchain
@@ -138,108 +320,160 @@ func (chain *Blockchain) Iterator() *BlockchainIterator {
 }
 
 // Next function - activate function for iterator
-func (iter *BlockchainIterator) Next() *Block {
+func (iter *BlockchainIterator) Next() (*Block, error) {
 	var block *Block
 
 	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		encodedBlock, err := item.Value()
-		block = Deserialize(encodedBlock)
-
+		var err error
+		block, err = getBlock(txn, iter.CurrentHash)
 		return err
 	})
-	HandleErr(err)
+	if err != nil {
+		return nil, fmt.Errorf("reading block %x: %w", iter.CurrentHash, err)
+	}
 
 	iter.CurrentHash = block.PrevBlockHash
 
-	return block
+	return block, nil
 }
 
-func (chain *Blockchain) FindUnspentTransactions() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
+// FindTransaction returns a confirmed transaction, using the transaction
+// index when it is enabled and scanning the chain from the tip otherwise
+func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := bc.FindTransactionBlock(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return *tx, nil
+}
 
-	spentTXOs := make(map[string][]int)
+// FindTransactionBlock works like FindTransaction, but also returns the
+// block holding the transaction
+func (bc *Blockchain) FindTransactionBlock(ID []byte) (*Transaction, *Block, error) {
+	var tx *Transaction
+	var block *Block
 
-	iter := chain.Iterator()
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tx, block, err = findBranchTransaction(txn, bc.LastHash, ID)
+		return err
+	})
+
+	return tx, block, err
+}
+
+// FindDataTransaction returns the first transaction of the main chain with
+// a null data output carrying data, together with the block holding it
+func (bc *Blockchain) FindDataTransaction(data []byte) (*Transaction, *Block, error) {
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes, err := bc.GetBlockHashes(0, height)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for {
-		block := iter.Next()
+	for _, hash := range hashes {
+		block, err := bc.GetBlockByHash(hash)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
-			}
-			if tx.IsCoinBase() == false {
-				for _, in := range tx.Inputs {
-					inTxID := hex.EncodeToString(in.ID)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
-				}
+			if tx.CarriesData(data) {
+				return tx, block, nil
 			}
 		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: no transaction carries %x", ErrTxNotFound, data)
+}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
+// lookupTransaction finds a transaction in the attached mempool or, failing
+// that, in the chain
+func (bc *Blockchain) lookupTransaction(ID []byte) (Transaction, error) {
+	if bc.mempool != nil {
+		if tx, ok := bc.mempool.Transaction(ID); ok {
+			return *tx, nil
 		}
 	}
 
-	return UTXO
+	return bc.FindTransaction(ID)
 }
 
-func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := bc.Iterator()
-
-	for {
-		block := iter.Next()
+func (bc *Blockchain) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
 
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
+	for _, in := range tx.Inputs {
+		prevTX, err := bc.lookupTransaction(in.ID)
+		if err != nil {
+			return nil, err
 		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+	return prevTXs, nil
+}
 
+func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey, hashType SigHashType) error {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return err
 	}
-	return Transaction{}, errors.New("Transaction doesn't exist")
+
+	return tx.Sign(privKey, prevTXs, hashType)
 }
 
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+// SignMultiSigTransaction adds the signature of privKey to the multisig
+// inputs of tx, see Transaction.SignMultiSig
+func (bc *Blockchain) SignMultiSigTransaction(tx *Transaction, privKey ecdsa.PrivateKey, hashType SigHashType) (int, error) {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return 0, err
+	}
 
-	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		HandleErr(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	return tx.SignMultiSig(privKey, prevTXs, hashType)
+}
+
+// NewPartialTransaction wraps tx for signing elsewhere, see the package
+// function
+func (bc *Blockchain) NewPartialTransaction(tx *Transaction) (*PartialTransaction, error) {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return nil, err
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return NewPartialTransaction(tx, prevTXs)
 }
 
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+// SignRawTransaction adds the signatures of privKey with hashType to the
+// inputs of tx it can sign, see Transaction.SignOwnInputs and
+// Transaction.SignMultiSig. It returns the number of inputs signed.
+func (bc *Blockchain) SignRawTransaction(tx *Transaction, privKey ecdsa.PrivateKey, hashType SigHashType) (int, error) {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return 0, err
+	}
 
+	signed, err := tx.SignOwnInputs(privKey, prevTXs, hashType)
+	if err != nil {
+		return signed, err
+	}
+	multiSigned, err := tx.SignMultiSig(privKey, prevTXs, hashType)
+
+	return signed + multiSigned, err
+}
+
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
 	if tx.IsCoinBase() {
-		return true
+		return true, nil
 	}
-	prevTXs := make(map[string]Transaction)
 
-	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		HandleErr(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return false, err
 	}
 
 	return tx.Verify(prevTXs)
@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+var blockIndexPrefix = []byte("bi-")
+
+// BlockNode is the block index entry of a stored block. Every block we have
+// accepted gets one, whether it is on the main chain or on a side branch.
+type BlockNode struct {
+	Hash      []byte
+	PrevHash  []byte
+	Height    int
+	Bits      uint32
+	Timestamp int64
+	ChainWork *big.Int
+	Invalid   bool
+}
+
+func (node *BlockNode) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(node)
+	HandleErr(err)
+
+	return res.Bytes()
+}
+
+func DeserializeBlockNode(data []byte) (*BlockNode, error) {
+	var node BlockNode
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&node); err != nil {
+		return nil, err
+	}
+
+	return &node, nil
+}
+
+func blockIndexKey(hash []byte) []byte {
+	return append(append([]byte{}, blockIndexPrefix...), hash...)
+}
+
+func getBlockNode(txn *badger.Txn, hash []byte) (*BlockNode, error) {
+	item, err := txn.Get(blockIndexKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	} else if err != nil {
+		return nil, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return DeserializeBlockNode(v)
+}
+
+func putBlockNode(txn *badger.Txn, node *BlockNode) error {
+	return txn.Set(blockIndexKey(node.Hash), node.Serialize())
+}
+
+// GetBlockNode returns the block index entry of a stored block
+func (chain *Blockchain) GetBlockNode(hash []byte) (*BlockNode, error) {
+	var node *BlockNode
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		node, err = getBlockNode(txn, hash)
+		return err
+	})
+
+	return node, err
+}
+
+// findFork returns the blocks to disconnect from the current tip and the
+// blocks to connect, lowest first, to make newTip the tip
+func findFork(txn *badger.Txn, oldTip, newTip *BlockNode) (detach, attach []*BlockNode, err error) {
+	for oldTip.Height > newTip.Height {
+		detach = append(detach, oldTip)
+		if oldTip, err = getBlockNode(txn, oldTip.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+	for newTip.Height > oldTip.Height {
+		attach = append([]*BlockNode{newTip}, attach...)
+		if newTip, err = getBlockNode(txn, newTip.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+	for !bytes.Equal(oldTip.Hash, newTip.Hash) {
+		detach = append(detach, oldTip)
+		attach = append([]*BlockNode{newTip}, attach...)
+		if oldTip, err = getBlockNode(txn, oldTip.PrevHash); err != nil {
+			return nil, nil, err
+		}
+		if newTip, err = getBlockNode(txn, newTip.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return detach, attach, nil
+}
@@ -0,0 +1,323 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// ProcessBlock validates a block received from outside and stores it. If it
+// makes a branch heavier than the current main chain, the chain reorganizes
+// to that branch, otherwise the block is kept on its side branch.
+func (chain *Blockchain) ProcessBlock(block *Block) error {
+	var node *BlockNode
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		if known, err := getBlockNode(txn, block.Hash); err == nil {
+			if known.Invalid {
+				return invalidBlock("block %x is known to be invalid", block.Hash)
+			}
+			return nil
+		}
+
+		parent, err := getBlockNode(txn, block.PrevBlockHash)
+		if errors.Is(err, ErrBlockNotFound) {
+			return invalidBlock("parent block %x is unknown", block.PrevBlockHash)
+		} else if err != nil {
+			return err
+		}
+		if parent.Invalid {
+			return invalidBlock("parent block %x is invalid", block.PrevBlockHash)
+		}
+
+		if err := chain.checkBlockSanity(txn, block, parent); err != nil {
+			return err
+		}
+
+		node = &BlockNode{
+			Hash:      block.Hash,
+			PrevHash:  block.PrevBlockHash,
+			Height:    block.Height,
+			Bits:      block.Bits,
+			Timestamp: block.Timestamp,
+			ChainWork: new(big.Int).Add(parent.ChainWork, CalcWork(block.Bits)),
+		}
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+
+		return putBlockNode(txn, node)
+	})
+	if err != nil || node == nil {
+		return err
+	}
+
+	tip, err := chain.GetBlockNode(chain.LastHash)
+	if err != nil {
+		return err
+	}
+	if node.ChainWork.Cmp(tip.ChainWork) <= 0 {
+		return nil
+	}
+
+	return chain.reorganize(tip, node)
+}
+
+// reorganize makes newTip the tip of the main chain. Blocks are disconnected
+// back to the fork point and the new branch is connected in a single database
+// transaction, so a block failing validation leaves the chain untouched.
+func (chain *Blockchain) reorganize(oldTip, newTip *BlockNode) error {
+	var failed *BlockNode
+	var disconnected, connected []*Block
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		detach, attach, err := findFork(txn, oldTip, newTip)
+		if err != nil {
+			return err
+		}
+
+		for _, node := range detach {
+			block, err := getBlock(txn, node.Hash)
+			if err != nil {
+				return err
+			}
+			if err := disconnectBlock(txn, block); err != nil {
+				return err
+			}
+			disconnected = append(disconnected, block)
+		}
+
+		for _, node := range attach {
+			block, err := getBlock(txn, node.Hash)
+			if err != nil {
+				return err
+			}
+			if err := chain.checkBlockContext(txn, block); err != nil {
+				// Only a broken consensus rule condemns the block, not a
+				// failure to read the database
+				if errors.Is(err, ErrInvalidBlock) {
+					failed = node
+				}
+				return err
+			}
+			if err := connectBlock(txn, block); err != nil {
+				return err
+			}
+			connected = append(connected, block)
+		}
+
+		return nil
+	})
+	if err != nil {
+		if failed != nil {
+			failed.Invalid = true
+			if putErr := chain.Database.Update(func(txn *badger.Txn) error {
+				return putBlockNode(txn, failed)
+			}); putErr != nil {
+				return fmt.Errorf("%w (marking block %x invalid: %v)", err, failed.Hash, putErr)
+			}
+		}
+		return err
+	}
+	chain.LastHash = newTip.Hash
+	chain.notifyMempool(disconnected, connected)
+
+	return nil
+}
+
+// connectBlock makes block, whose parent is the current tip, the new tip
+func connectBlock(txn *badger.Txn, block *Block) error {
+	if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	if err := indexTransactions(txn, block); err != nil {
+		return err
+	}
+	if err := updateUTXO(txn, block); err != nil {
+		return err
+	}
+
+	return txn.Set(lastHashKey, block.Hash)
+}
+
+// disconnectBlock removes the tip block from the main chain, making its
+// parent the tip again
+func disconnectBlock(txn *badger.Txn, block *Block) error {
+	if err := txn.Delete(heightKey(block.Height)); err != nil {
+		return err
+	}
+	if err := unindexTransactions(txn, block); err != nil {
+		return err
+	}
+	if err := rollbackUTXO(txn, block); err != nil {
+		return err
+	}
+
+	return txn.Set(lastHashKey, block.PrevBlockHash)
+}
+
+// InvalidateBlock marks a block as invalid. If it is on the main chain, the
+// chain is rolled back to its parent using the undo records and then moves to
+// the most-work branch that contains no invalid block.
+func (chain *Blockchain) InvalidateBlock(hash []byte) error {
+	var newTip []byte
+	var disconnected []*Block
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		node, err := getBlockNode(txn, hash)
+		if err != nil {
+			return err
+		}
+		if node.Height == 0 {
+			return errors.New("the genesis block can not be invalidated")
+		}
+		node.Invalid = true
+		if err := putBlockNode(txn, node); err != nil {
+			return err
+		}
+
+		onMainChain, err := isMainChain(txn, node)
+		if err != nil || !onMainChain {
+			return err
+		}
+
+		for tipHash := chain.LastHash; !bytes.Equal(tipHash, node.PrevHash); {
+			block, err := getBlock(txn, tipHash)
+			if err != nil {
+				return err
+			}
+			if err := disconnectBlock(txn, block); err != nil {
+				return err
+			}
+			disconnected = append(disconnected, block)
+			tipHash = block.PrevBlockHash
+		}
+		newTip = node.PrevHash
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if newTip != nil {
+		chain.LastHash = newTip
+		chain.notifyMempool(disconnected, nil)
+	}
+
+	return chain.activateBestChain()
+}
+
+// notifyMempool tells the attached mempool, if any, which blocks left and
+// joined the main chain. disconnected is ordered from the old tip backwards
+// and connected from the fork point forwards.
+func (chain *Blockchain) notifyMempool(disconnected, connected []*Block) {
+	if chain.mempool != nil {
+		chain.mempool.chainChanged(disconnected, connected)
+	}
+}
+
+// isMainChain reports whether node is part of the main chain
+func isMainChain(txn *badger.Txn, node *BlockNode) (bool, error) {
+	item, err := txn.Get(heightKey(node.Height))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	hash, err := item.Value()
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(hash, node.Hash), nil
+}
+
+// activateBestChain reorganizes to the valid branch with the most work. A
+// branch whose block fails validation is marked invalid and the next best one
+// is tried.
+func (chain *Blockchain) activateBestChain() error {
+	for {
+		tip, err := chain.GetBlockNode(chain.LastHash)
+		if err != nil {
+			return err
+		}
+
+		candidate, err := chain.bestCandidate(tip)
+		if err != nil || candidate == nil {
+			return err
+		}
+
+		err = chain.reorganize(tip, candidate)
+		if err != nil && !errors.Is(err, ErrInvalidBlock) {
+			return err
+		}
+		if err == nil {
+			return nil
+		}
+	}
+}
+
+// bestCandidate returns the stored block with more work than tip whose
+// branch has no invalid blocks, or nil if there is none
+func (chain *Blockchain) bestCandidate(tip *BlockNode) (*BlockNode, error) {
+	var best *BlockNode
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var candidates []*BlockNode
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(blockIndexPrefix); it.ValidForPrefix(blockIndexPrefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			node, err := DeserializeBlockNode(v)
+			if err != nil {
+				return err
+			}
+			if node.ChainWork.Cmp(tip.ChainWork) > 0 {
+				candidates = append(candidates, node)
+			}
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].ChainWork.Cmp(candidates[j].ChainWork) > 0
+		})
+
+		for _, candidate := range candidates {
+			valid, err := validBranch(txn, candidate)
+			if err != nil {
+				return err
+			}
+			if valid {
+				best = candidate
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return best, err
+}
+
+// validBranch walks back from node to the main chain and reports whether no
+// block on the way is marked invalid
+func validBranch(txn *badger.Txn, node *BlockNode) (bool, error) {
+	for {
+		if node.Invalid {
+			return false, nil
+		}
+		onMainChain, err := isMainChain(txn, node)
+		if err != nil || onMainChain {
+			return err == nil, err
+		}
+		if node, err = getBlockNode(txn, node.PrevHash); err != nil {
+			return false, err
+		}
+	}
+}
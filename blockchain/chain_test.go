@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// solveBlock returns a block of txs on top of parent, with the difficulty
+// the chain requires and a solved proof of work, without processing it
+func solveBlock(t *testing.T, chain *Blockchain, parent *Block, txs ...*Transaction) *Block {
+	t.Helper()
+
+	bits, err := chain.CalcNextRequiredBits(parent.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newBlock(parent.Timestamp+1, txs, parent.Hash, parent.Height+1, bits)
+	if err := NewProofOfWork(block).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// processOn processes a block on top of parent holding a coinbase paying
+// miner and txs
+func processOn(t *testing.T, chain *Blockchain, parent *Block, miner *wallet.Wallet, txs ...*Transaction) *Block {
+	t.Helper()
+
+	coinbase, err := CoinbaseTx(string(miner.Address(chain.Params.AddressVersion)), "", parent.Height+1, 0, chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := solveBlock(t, chain, parent, append([]*Transaction{coinbase}, txs...)...)
+	if err := chain.ProcessBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// checkMainChain fails unless blocks are the main chain above the genesis
+// block, in order
+func checkMainChain(t *testing.T, chain *Blockchain, blocks ...*Block) {
+	t.Helper()
+
+	tip := blocks[len(blocks)-1]
+	if !bytes.Equal(chain.LastHash, tip.Hash) {
+		t.Fatalf("tip is %x, want %x", chain.LastHash, tip.Hash)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != len(blocks) {
+		t.Errorf("best height = %d, %v; want %d", height, err, len(blocks))
+	}
+	for _, block := range blocks {
+		stored, err := chain.GetBlockByHeight(block.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored.Hash, block.Hash) {
+			t.Errorf("block at height %d is %x, want %x", block.Height, stored.Hash, block.Hash)
+		}
+	}
+}
+
+func TestReorganize(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+	bob, carol, dave := wallet.CreateWallet(), wallet.CreateWallet(), wallet.CreateWallet()
+	u := UTXOSet{chain}
+
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two payments from the genesis output, each mined on its own branch
+	toBob, err := NewTransaction(alice, addressOn(chain, bob), 20, Fee{}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toDave, err := NewTransaction(alice, addressOn(chain, dave), 30, Fee{}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1 := processOn(t, chain, genesis, alice, toBob)
+	checkMainChain(t, chain, a1)
+
+	// A side branch of the same work does not replace the main chain
+	b1 := processOn(t, chain, genesis, carol, toDave)
+	checkMainChain(t, chain, a1)
+	checkBalance(t, chain, bob, 20)
+
+	// A heavier one does
+	b2 := processOn(t, chain, b1, carol)
+	checkMainChain(t, chain, b1, b2)
+
+	for _, w := range []struct {
+		owner *wallet.Wallet
+		want  int
+	}{{alice, 20}, {bob, 0}, {carol, 100}, {dave, 30}} {
+		checkBalance(t, chain, w.owner, w.want)
+	}
+	for _, out := range []struct {
+		tx *Transaction
+		n  int
+	}{{toBob, 0}, {toBob, 1}, {a1.Transactions[0], 0}} {
+		if _, err := u.GetUTXO(out.tx.ID, out.n); !errors.Is(err, ErrTxNotFound) {
+			t.Errorf("output %x:%d of the old branch is unspent: %v", out.tx.ID, out.n, err)
+		}
+	}
+	if entry, err := u.GetUTXO(toDave.ID, 0); err != nil || entry.Height != 1 {
+		t.Errorf("output of the new branch = %+v, %v; want it unspent from height 1", entry, err)
+	}
+	if _, err := chain.FindTransaction(toBob.ID); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("transaction of the old branch is still found: %v", err)
+	}
+
+	// The set matches a replay of the new main chain
+	count, err := u.CountUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if reindexed, err := u.CountUTXO(); err != nil || reindexed != count {
+		t.Errorf("reindexed set has %d outputs, %v; want %d", reindexed, err, count)
+	}
+
+	// Outgrowing the new branch switches back to the first one
+	a2 := processOn(t, chain, a1, alice)
+	checkMainChain(t, chain, b1, b2)
+	a3 := processOn(t, chain, a2, alice)
+	checkMainChain(t, chain, a1, a2, a3)
+
+	checkBalance(t, chain, bob, 20)
+	checkBalance(t, chain, dave, 0)
+	checkBalance(t, chain, carol, 0)
+	if _, err := u.GetUTXO(toDave.ID, 0); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("output of the abandoned branch is unspent: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"math/big"
+	"sort"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// medianTimeBlocks is the number of blocks used to compute the median time past
+const medianTimeBlocks = 11
+
+// CompactToBig converts the compact representation used in block headers to
+// a target. Like Bitcoin's nBits, the highest byte is the length of the
+// number in bytes, bit 23 is the sign and the lower 23 bits the mantissa.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+
+	return bn
+}
+
+// BigToCompact converts a target to its compact representation
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Set(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// CalcWork returns the expected number of hashes needed to find a block with
+// the given difficulty, 2^256 / (target + 1)
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	work := big.NewInt(1)
+	work.Lsh(work, 256)
+
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+// calcNextRequiredBits returns the difficulty a block on top of parent must
+// have. It only changes every RetargetInterval blocks, by the ratio between
+// the time the last interval took and the time it should have taken, limited
+// to a factor of four either way.
+func (chain *Blockchain) calcNextRequiredBits(txn *badger.Txn, parent *BlockNode) (uint32, error) {
+	params := chain.Params
+	interval := params.RetargetInterval
+
+	if params.NoRetargeting || (parent.Height+1)%interval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := 0; i < interval-1 && len(first.PrevHash) > 0; i++ {
+		var err error
+		if first, err = getBlockNode(txn, first.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+
+	targetTimespan := int64(params.TargetTimePerBlock.Seconds()) * int64(interval)
+	actualTimespan := parent.Timestamp - first.Timestamp
+	if actualTimespan < targetTimespan/4 {
+		actualTimespan = targetTimespan / 4
+	} else if actualTimespan > targetTimespan*4 {
+		actualTimespan = targetTimespan * 4
+	}
+
+	newTarget := CompactToBig(parent.Bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(params.PowLimit) > 0 {
+		newTarget.Set(params.PowLimit)
+	}
+
+	return BigToCompact(newTarget), nil
+}
+
+// CalcNextRequiredBits returns the difficulty required of a block whose
+// parent has hash prevHash. The genesis block, with no parent, uses the PoW limit.
+func (chain *Blockchain) CalcNextRequiredBits(prevHash []byte) (uint32, error) {
+	if len(prevHash) == 0 {
+		return chain.Params.PowLimitBits, nil
+	}
+
+	var bits uint32
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		parent, err := getBlockNode(txn, prevHash)
+		if err != nil {
+			return err
+		}
+		bits, err = chain.calcNextRequiredBits(txn, parent)
+		return err
+	})
+
+	return bits, err
+}
+
+// medianTimePast returns the median timestamp of the last blocks ending at node.
+// A new block must have a later timestamp.
+func medianTimePast(txn *badger.Txn, node *BlockNode) (int64, error) {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeBlocks; i++ {
+		timestamps = append(timestamps, node.Timestamp)
+		if len(node.PrevHash) == 0 {
+			break
+		}
+
+		var err error
+		if node, err = getBlockNode(txn, node.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
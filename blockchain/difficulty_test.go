@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	badger "github.com/dgraph-io/badger"
+)
+
+func TestCompactToBig(t *testing.T) {
+	hexInt := func(s string) *big.Int {
+		n, ok := new(big.Int).SetString(s, 16)
+		if !ok {
+			t.Fatalf("bad test number %s", s)
+		}
+		return n
+	}
+
+	tests := []struct {
+		compact uint32
+		n       *big.Int
+		// canonical is what n converts back to, when that is not compact
+		canonical uint32
+	}{
+		{0x00000000, big.NewInt(0), 0},
+		{0x01003456, big.NewInt(0), 0x00000000},
+		{0x01123456, big.NewInt(0x12), 0x01120000},
+		{0x02008000, big.NewInt(0x80), 0},
+		{0x02123456, big.NewInt(0x1234), 0x02123400},
+		{0x03123456, big.NewInt(0x123456), 0},
+		{0x04123456, big.NewInt(0x12345600), 0},
+		{0x05009234, big.NewInt(0x92340000), 0},
+		{0x1d00ffff, hexInt("ffff" + strings.Repeat("0", 52)), 0},
+		{0x200fffff, hexInt("0fffff" + strings.Repeat("0", 58)), 0},
+		{0x20123456, hexInt("123456" + strings.Repeat("0", 58)), 0},
+
+		// Bit 23 is the sign, so a mantissa reaching it moves a byte up
+		{0x01fedcba, big.NewInt(-0x7e), 0x01fe0000},
+		{0x04923456, big.NewInt(-0x12345600), 0},
+		{0x03800000, big.NewInt(0), 0x00000000},
+	}
+	for _, tt := range tests {
+		if got := CompactToBig(tt.compact); got.Cmp(tt.n) != 0 {
+			t.Errorf("CompactToBig(%08x) = %x, want %x", tt.compact, got, tt.n)
+		}
+
+		want := tt.compact
+		if tt.canonical != 0 || tt.n.Sign() == 0 {
+			want = tt.canonical
+		}
+		compact := BigToCompact(tt.n)
+		if compact != want {
+			t.Errorf("BigToCompact(%x) = %08x, want %08x", tt.n, compact, want)
+		}
+		if back := CompactToBig(compact); back.Cmp(tt.n) != 0 {
+			t.Errorf("%x round trips to %x", tt.n, back)
+		}
+	}
+
+	// Precision beyond the mantissa is lost, rounding towards zero
+	n := hexInt("123456789abcdef")
+	if compact := BigToCompact(n); compact != 0x08012345 {
+		t.Errorf("BigToCompact(%x) = %08x, want 08012345", n, compact)
+	}
+}
+
+// indexNodes stores a branch of block index entries with the given bits and
+// timestamps, starting at height 0, and returns its tip
+func indexNodes(t *testing.T, chain *Blockchain, name string, bits uint32, timestamps ...int64) *BlockNode {
+	t.Helper()
+
+	var node *BlockNode
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		var prevHash []byte
+		for height, timestamp := range timestamps {
+			node = &BlockNode{
+				Hash:      []byte(fmt.Sprintf("%s %d", name, height)),
+				PrevHash:  prevHash,
+				Height:    height,
+				Bits:      bits,
+				Timestamp: timestamp,
+				ChainWork: big.NewInt(0),
+			}
+			if err := putBlockNode(txn, node); err != nil {
+				return err
+			}
+			prevHash = node.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+func TestCalcNextRequiredBits(t *testing.T) {
+	params := chaincfg.RegTestParams
+	params.NoRetargeting = false
+	params.RetargetInterval = 4
+	params.TargetTimePerBlock = time.Minute
+	chain, _, cleanup := newTestChainParams(t, params)
+	defer cleanup()
+
+	// The interval should take four minutes
+	const start = 1562889600
+	interval := func(span int64) []int64 {
+		return []int64{start, start + 60, start + 120, start + span}
+	}
+
+	tests := []struct {
+		name       string
+		bits       uint32
+		timestamps []int64
+		want       uint32
+	}{
+		{"on time", 0x1e00ffff, interval(240), 0x1e00ffff},
+		{"twice as fast", 0x1e00ffff, interval(120), 0x1d7fff80},
+		{"twice as slow", 0x1e00ffff, interval(480), 0x1e01fffe},
+		{"clamped fast", 0x1e00ffff, interval(10), 0x1d3fffc0},
+		{"clamped timestamps going back", 0x1e00ffff, interval(-1000), 0x1d3fffc0},
+		{"clamped slow", 0x1e00ffff, interval(240 * 10), 0x1e03fffc},
+		{"at the limit", 0x1e03fffc, interval(240 * 4), 0x1e0ffff0},
+		{"capped at the pow limit", params.PowLimitBits, interval(240 * 4), params.PowLimitBits},
+		{"between retargets", 0x1e00ffff, interval(10)[:3], 0x1e00ffff},
+	}
+	for _, tt := range tests {
+		parent := indexNodes(t, chain, tt.name, tt.bits, tt.timestamps...)
+
+		var bits uint32
+		err := chain.Database.View(func(txn *badger.Txn) error {
+			var err error
+			bits, err = chain.calcNextRequiredBits(txn, parent)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if bits != tt.want {
+			t.Errorf("%s: bits = %08x, want %08x", tt.name, bits, tt.want)
+		}
+	}
+
+	// Without retargeting the bits never change
+	chain.Params.NoRetargeting = true
+	parent := indexNodes(t, chain, "no retargeting", 0x1e00ffff, interval(10)...)
+	if bits, err := chain.CalcNextRequiredBits(parent.Hash); err != nil || bits != 0x1e00ffff {
+		t.Errorf("bits without retargeting = %08x, %v; want 1e00ffff", bits, err)
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	chain, _, cleanup := newTestChain(t)
+	defer cleanup()
+
+	tests := []struct {
+		name       string
+		timestamps []int64
+		want       int64
+	}{
+		{"single block", []int64{100}, 100},
+		{"short branch", []int64{100, 300, 200}, 200},
+		{"even count", []int64{100, 400, 200, 300}, 300},
+		{"out of order", []int64{10, 90, 20, 80, 30, 70, 40, 60, 50, 100, 0}, 50},
+		// Only the last medianTimeBlocks count
+		{"long branch", []int64{1000, 1000, 1000, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, 6},
+	}
+	for _, tt := range tests {
+		tip := indexNodes(t, chain, tt.name, chain.Params.PowLimitBits, tt.timestamps...)
+
+		var median int64
+		err := chain.Database.View(func(txn *badger.Txn) error {
+			var err error
+			median, err = medianTimePast(txn, tip)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if median != tt.want {
+			t.Errorf("%s: median time past = %d, want %d", tt.name, median, tt.want)
+		}
+	}
+}
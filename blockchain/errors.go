@@ -0,0 +1,19 @@
+package blockchain
+
+import "errors"
+
+// Sentinel errors returned by the blockchain package. Callers should compare
+// against them with errors.Is, since they are usually wrapped with context.
+var (
+	ErrChainExists          = errors.New("blockchain already exists")
+	ErrNoChain              = errors.New("no blockchain found, create one first")
+	ErrInsufficientFunds    = errors.New("not enough funds")
+	ErrTxNotFound           = errors.New("transaction not found")
+	ErrInvalidBlock         = errors.New("invalid block")
+	ErrBlockNotFound        = errors.New("block not found")
+	ErrTxRejected           = errors.New("transaction rejected")
+	ErrTxConflict           = errors.New("transaction conflicts with the mempool")
+	ErrNoSecret             = errors.New("transaction does not reveal the secret")
+	ErrIncompleteSignatures = errors.New("transaction is not fully signed")
+	ErrInvalidAddress       = errors.New("invalid address")
+)
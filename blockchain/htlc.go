@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// NewSecret returns a random secret for a hash time-locked contract together
+// with its SHA-256 hash
+func NewSecret() ([]byte, []byte, error) {
+	secret := make([]byte, script.SecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256(secret)
+
+	return secret, hash[:], nil
+}
+
+// NewHTLC returns a hash time-locked contract paying the address recipient
+// against the secret of secretHash, or back to the address refund once
+// lockTime has passed. Both are key addresses of params. It is paid to through
+// its script address.
+func NewHTLC(secretHash []byte, recipient string, lockTime int64, refund string, params *chaincfg.ChainParams) ([]byte, error) {
+	if len(secretHash) != sha256.Size {
+		return nil, fmt.Errorf("secret hash must be %d bytes", sha256.Size)
+	}
+	if lockTime <= 0 {
+		return nil, fmt.Errorf("invalid lock time %d", lockTime)
+	}
+	for _, address := range []string{recipient, refund} {
+		if !wallet.ValidateAddress(address, params.AddressVersion) {
+			return nil, fmt.Errorf("%w: %q is not a key address", ErrInvalidAddress, address)
+		}
+	}
+
+	return script.HTLCScript(secretHash, wallet.AddressHash(recipient), lockTime, wallet.AddressHash(refund)), nil
+}
+
+// RedeemHTLC builds and signs a transaction spending the output of the
+// contract transaction contractTxID paid to contract with secret. It pays the
+// output value less fee to the recipient w, whose key the contract names.
+func (bc *Blockchain) RedeemHTLC(contract, contractTxID, secret []byte, w *wallet.Wallet, fee int) (*Transaction, error) {
+	secretHash, recipient, _, _, ok := script.ExtractHTLC(contract)
+	if !ok {
+		return nil, errors.New("not a hash time-locked contract")
+	}
+	if hash := sha256.Sum256(secret); !bytes.Equal(hash[:], secretHash) {
+		return nil, errors.New("secret does not match the secret hash of the contract")
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), recipient) {
+		return nil, errors.New("wallet is not the recipient of the contract")
+	}
+
+	return bc.spendHTLC(contract, contractTxID, w, fee, 0, func(sig []byte) []byte {
+		return script.UnlockHTLCRedeem(sig, w.PublicKey, secret)
+	})
+}
+
+// RefundHTLC builds and signs a transaction returning the output of the
+// contract transaction contractTxID paid to contract to its sender w, less
+// fee. The transaction is locked until the lock time of the contract.
+func (bc *Blockchain) RefundHTLC(contract, contractTxID []byte, w *wallet.Wallet, fee int) (*Transaction, error) {
+	_, _, lockTime, refund, ok := script.ExtractHTLC(contract)
+	if !ok {
+		return nil, errors.New("not a hash time-locked contract")
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), refund) {
+		return nil, errors.New("wallet is not the refund address of the contract")
+	}
+
+	return bc.spendHTLC(contract, contractTxID, w, fee, lockTime, func(sig []byte) []byte {
+		return script.UnlockHTLCRefund(sig, w.PublicKey)
+	})
+}
+
+// spendHTLC pays the contract output of contractTxID to w, with an unlocking
+// script made by unlock from the signature of w
+func (bc *Blockchain) spendHTLC(contract, contractTxID []byte, w *wallet.Wallet, fee int, lockTime int64, unlock func(sig []byte) []byte) (*Transaction, error) {
+	contractTx, err := bc.lookupTransaction(contractTxID)
+	if err != nil {
+		return nil, err
+	}
+
+	lockingScript := script.PayToScriptHash(wallet.PublicKeyHash(contract))
+	out := -1
+	for i, output := range contractTx.Outputs {
+		if bytes.Equal(output.LockingScript, lockingScript) {
+			out = i
+			break
+		}
+	}
+	if out < 0 {
+		return nil, fmt.Errorf("transaction %x does not pay to the contract", contractTxID)
+	}
+
+	value := contractTx.Outputs[out].Value - fee
+	if fee < 0 || value <= 0 {
+		return nil, fmt.Errorf("invalid fee %d for a contract of %d", fee, contractTx.Outputs[out].Value)
+	}
+
+	payment := TxOutput{value, script.PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))}
+	tx := Transaction{
+		Inputs:   []TxInput{{ID: contractTx.ID, Out: out}},
+		Outputs:  []TxOutput{payment},
+		LockTime: lockTime,
+	}
+	tx.ID = tx.Hash()
+
+	sig, err := tx.SignInput(0, contract, w.PrivateKey, SigHashAll)
+	if err != nil {
+		return nil, err
+	}
+	tx.Inputs[0].UnlockingScript = script.UnlockScriptHash(unlock(sig), contract)
+
+	return &tx, nil
+}
+
+// ExtractSecret returns the preimage of secretHash revealed by the unlocking
+// scripts of tx, the redemption of a hash time-locked contract
+func ExtractSecret(tx *Transaction, secretHash []byte) ([]byte, error) {
+	for _, in := range tx.Inputs {
+		items, err := script.PushedData(in.UnlockingScript)
+		if err != nil {
+			continue
+		}
+
+		for _, item := range items {
+			if hash := sha256.Sum256(item); bytes.Equal(hash[:], secretHash) {
+				return item, nil
+			}
+		}
+	}
+
+	return nil, ErrNoSecret
+}
@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// swapParams is a second network for the swap tests, with its own addresses
+var swapParams = func() chaincfg.ChainParams {
+	params := chaincfg.RegTestParams
+	params.Name = "swapnet"
+	params.GenesisMessage = "Swap test genesis block"
+	params.AddressVersion = 0x3c
+	params.ScriptAddressVersion = 0x3d
+
+	return params
+}()
+
+// addressOn returns the key address of w on the network of chain
+func addressOn(chain *Blockchain, w *wallet.Wallet) string {
+	return string(w.Address(chain.Params.AddressVersion))
+}
+
+// fundHTLC pays value from sender to a new contract on chain, in a block it
+// mines. The lock time of the contract is lockBlocks past that block.
+func fundHTLC(t *testing.T, chain *Blockchain, sender, recipient *wallet.Wallet, secretHash []byte, lockBlocks, value int) ([]byte, *Transaction) {
+	t.Helper()
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := NewHTLC(secretHash, addressOn(chain, recipient), int64(height+1+lockBlocks), addressOn(chain, sender), chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contractAddress := string(wallet.ScriptAddress(contract, chain.Params.ScriptAddressVersion))
+	tx, err := NewTransaction(sender, contractAddress, value, Fee{}, PaymentLock{}, &UTXOSet{chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain, sender, tx)
+
+	return contract, tx
+}
+
+func checkBalance(t *testing.T, chain *Blockchain, w *wallet.Wallet, want int) {
+	t.Helper()
+
+	spendable, _, err := UTXOSet{chain}.Balance(addressOn(chain, w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spendable != want {
+		t.Errorf("balance on %s = %d, want %d", chain.Params.Name, spendable, want)
+	}
+}
+
+// newSwap opens a regtest chain whose genesis block pays alice and a swapnet
+// chain whose genesis block pays bob
+func newSwap(t *testing.T) (chain1, chain2 *Blockchain, alice, bob *wallet.Wallet, cleanup func()) {
+	chain1, alice, cleanup1 := newTestChain(t)
+	chain2, bob, cleanup2 := newTestChainParams(t, swapParams)
+
+	return chain1, chain2, alice, bob, func() {
+		cleanup1()
+		cleanup2()
+	}
+}
+
+func TestAtomicSwap(t *testing.T) {
+	chain1, chain2, alice, bob, cleanup := newSwap(t)
+	defer cleanup()
+
+	// Alice initiates on her chain, bob participates on his with a shorter
+	// lock time and the same secret hash
+	secret, secretHash, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract1, fund1 := fundHTLC(t, chain1, alice, bob, secretHash, 8, 10)
+	contract2, fund2 := fundHTLC(t, chain2, bob, alice, secretHash, 4, 7)
+
+	// A contract is only known on its own chain
+	if _, err := chain1.RedeemHTLC(contract2, fund2.ID, secret, alice, 1); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("redeeming on the wrong chain: got %v, want %v", err, ErrTxNotFound)
+	}
+
+	// Alice redeems on bob's chain, revealing the secret
+	redeem2, err := chain2.RedeemHTLC(contract2, fund2.ID, secret, alice, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain2, bob, redeem2)
+
+	// Bob finds the redemption on his chain and uses its secret on alice's
+	confirmed, err := chain2.FindTransaction(redeem2.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := ExtractSecret(&confirmed, secretHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(extracted, secret) {
+		t.Fatalf("extracted secret %x, want %x", extracted, secret)
+	}
+	redeem1, err := chain1.RedeemHTLC(contract1, fund1.ID, extracted, bob, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain1, alice, redeem1)
+
+	// Each owner mines its chain and collects the fee of the redemption
+	checkBalance(t, chain1, bob, 9)
+	checkBalance(t, chain2, alice, 6)
+	checkBalance(t, chain1, alice, 50*3-10+1)
+	checkBalance(t, chain2, bob, 50*3-7+1)
+}
+
+func TestAtomicSwapRefund(t *testing.T) {
+	chain1, chain2, alice, bob, cleanup := newSwap(t)
+	defer cleanup()
+
+	// Alice never redeems, so both sides take their coins back
+	_, secretHash, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract1, fund1 := fundHTLC(t, chain1, alice, bob, secretHash, 4, 10)
+	contract2, fund2 := fundHTLC(t, chain2, bob, alice, secretHash, 2, 7)
+
+	if _, err := chain2.RefundHTLC(contract2, fund2.ID, alice, 1); err == nil {
+		t.Error("refund by the recipient was built")
+	}
+
+	tests := []struct {
+		chain    *Blockchain
+		sender   *wallet.Wallet
+		contract []byte
+		fund     *Transaction
+		blocks   int
+	}{
+		{chain2, bob, contract2, fund2, 2},
+		{chain1, alice, contract1, fund1, 4},
+	}
+	for _, tt := range tests {
+		refund, err := tt.chain.RefundHTLC(tt.contract, tt.fund.ID, tt.sender, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The refund is locked until the lock time of the contract has passed
+		for i := 0; i < tt.blocks; i++ {
+			pool := NewMempool(tt.chain, DefaultMaxMempoolSize)
+			if err := pool.AddTransaction(refund); !errors.Is(err, ErrTxRejected) {
+				t.Fatalf("refund on %s after %d blocks: got %v, want %v", tt.chain.Params.Name, i, err, ErrTxRejected)
+			}
+			mineTransactions(t, tt.chain, tt.sender)
+		}
+		mineTransactions(t, tt.chain, tt.sender, refund)
+
+		if _, err := ExtractSecret(refund, secretHash); !errors.Is(err, ErrNoSecret) {
+			t.Errorf("refund on %s revealed a secret: %v", tt.chain.Params.Name, err)
+		}
+		// The sender mined every block, including the refund and its fee
+		checkBalance(t, tt.chain, tt.sender, 50*(tt.blocks+3))
+	}
+}
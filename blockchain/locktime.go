@@ -0,0 +1,245 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+	badger "github.com/dgraph-io/badger"
+)
+
+// Relative locks in TxInput.Sequence follow BIP 68. The low bits hold how
+// old the spent output must be, in blocks or, with SequenceLockTimeIsSeconds
+// set, in units of 1<<SequenceLockTimeGranularity seconds. A zero sequence
+// asks for no age, and SequenceLockTimeDisabled turns the lock off.
+const (
+	SequenceLockTimeDisabled    = 1 << 31
+	SequenceLockTimeIsSeconds   = 1 << 22
+	SequenceLockTimeMask        = 0xffff
+	SequenceLockTimeGranularity = 9
+)
+
+// RelativeLockBlocks returns the sequence of an input that may only be mined
+// once the output it spends has been in the chain for blocks blocks
+func RelativeLockBlocks(blocks int) (uint32, error) {
+	if blocks < 0 || blocks > SequenceLockTimeMask {
+		return 0, errors.New("relative lock is out of range")
+	}
+
+	return uint32(blocks), nil
+}
+
+// RelativeLockSeconds returns the sequence of an input that may only be mined
+// once seconds have passed since the output it spends was mined, rounded up
+// to the granularity of relative locks
+func RelativeLockSeconds(seconds int64) (uint32, error) {
+	units := (seconds + 1<<SequenceLockTimeGranularity - 1) >> SequenceLockTimeGranularity
+	if seconds < 0 || units > SequenceLockTimeMask {
+		return 0, errors.New("relative lock is out of range")
+	}
+
+	return SequenceLockTimeIsSeconds | uint32(units), nil
+}
+
+// PaymentLock keeps the output of a new payment from being spent before
+// LockTime, a height or a Unix time like Transaction.LockTime, or before it
+// is Sequence old, encoded like TxInput.Sequence. The zero PaymentLock pays
+// without a lock.
+type PaymentLock struct {
+	LockTime int64
+	Sequence uint32
+}
+
+// output returns the output paying value to the address to under lock
+func (lock PaymentLock) output(value int, to string, params *chaincfg.ChainParams) (*TxOutput, error) {
+	if lock.LockTime == 0 && lock.Sequence == 0 {
+		return NewTxOutput(value, to, params)
+	}
+
+	if !wallet.ValidateAddress(to, params.AddressVersion) {
+		return nil, fmt.Errorf("%w: only key addresses can be paid with a lock", ErrInvalidAddress)
+	}
+	pubKeyHash := wallet.AddressHash(to)
+
+	switch {
+	case lock.LockTime != 0 && lock.Sequence != 0:
+		return nil, errors.New("a payment takes either a lock time or a relative lock")
+	case lock.LockTime < 0 || lock.LockTime > math.MaxUint32:
+		return nil, errors.New("lock time is out of range")
+	case lock.LockTime != 0:
+		return &TxOutput{value, script.TimeLockScript(lock.LockTime, pubKeyHash)}, nil
+	case lock.Sequence&SequenceLockTimeDisabled != 0:
+		return nil, errors.New("relative lock is disabled")
+	default:
+		return &TxOutput{value, script.SequenceLockScript(int64(lock.Sequence), pubKeyHash)}, nil
+	}
+}
+
+// keyLock returns the lock time and the input sequence a transaction needs
+// to spend out with the key of pubKeyHash alone: none for pay-to-pubkey-hash
+// outputs and the lock of time-lock and sequence-lock outputs. ok is false
+// for any other output.
+func keyLock(out TxOutput, pubKeyHash []byte) (lockTime int64, sequence uint32, ok bool) {
+	if out.IsLockByKey(pubKeyHash) {
+		return 0, 0, true
+	}
+
+	if lockTime, hash, ok := script.ExtractTimeLock(out.LockingScript); ok {
+		return lockTime, 0, lockTime >= 0 && bytes.Equal(hash, pubKeyHash)
+	}
+	if sequence, hash, ok := script.ExtractSequenceLock(out.LockingScript); ok {
+		valid := sequence >= 0 && sequence <= math.MaxUint32 && sequence&SequenceLockTimeDisabled == 0
+		return 0, uint32(sequence), valid && bytes.Equal(hash, pubKeyHash)
+	}
+
+	return 0, 0, false
+}
+
+// lockState decides whether locks allow a transaction into the block after
+// tip, whose median time past is medianTime
+type lockState struct {
+	tip        *BlockNode
+	medianTime int64
+}
+
+func newLockState(txn *badger.Txn, tipHash []byte) (*lockState, error) {
+	tip, err := getBlockNode(txn, tipHash)
+	if err != nil {
+		return nil, err
+	}
+	medianTime, err := medianTimePast(txn, tip)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lockState{tip, medianTime}, nil
+}
+
+// lockTimeReached reports whether a transaction with lockTime is final
+func (s *lockState) lockTimeReached(lockTime int64) bool {
+	tx := Transaction{LockTime: lockTime}
+
+	return tx.IsFinal(s.tip.Height+1, s.medianTime)
+}
+
+// sequenceReached reports whether an input with sequence may spend an output
+// created at height. Time locks count from the median time past of the block
+// before the one that created the output.
+func (s *lockState) sequenceReached(txn *badger.Txn, sequence uint32, height int) (bool, error) {
+	if sequence&SequenceLockTimeDisabled != 0 {
+		return true, nil
+	}
+
+	age := int64(sequence & SequenceLockTimeMask)
+	if sequence&SequenceLockTimeIsSeconds == 0 {
+		return int64(height)+age <= int64(s.tip.Height+1), nil
+	}
+
+	node, err := ancestorNode(txn, s.tip, height-1)
+	if err != nil {
+		return false, err
+	}
+	created, err := medianTimePast(txn, node)
+	if err != nil {
+		return false, err
+	}
+
+	return created+age<<SequenceLockTimeGranularity <= s.medianTime, nil
+}
+
+// spendable reports whether the next block may spend an output created at
+// height with a transaction carrying lockTime and an input with sequence
+func (s *lockState) spendable(txn *badger.Txn, lockTime int64, sequence uint32, height int) (bool, error) {
+	if !s.lockTimeReached(lockTime) {
+		return false, nil
+	}
+
+	return s.sequenceReached(txn, sequence, height)
+}
+
+// ancestorNode returns the block at height on the branch ending at node, or
+// the genesis block for negative heights
+func ancestorNode(txn *badger.Txn, node *BlockNode, height int) (*BlockNode, error) {
+	for node.Height > height && len(node.PrevHash) > 0 {
+		var err error
+		if node, err = getBlockNode(txn, node.PrevHash); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// keySelector picks the outputs a key can spend in the block after the tip.
+// The time-locked outputs it picks all have lock times of one kind, heights
+// or timestamps, since they share the lock time of the spending transaction.
+type keySelector struct {
+	pubKeyHash []byte
+	tipHash    []byte
+
+	state   *lockState
+	heights bool
+	times   bool
+}
+
+func (k *keySelector) pick(txn *badger.Txn, out TxOutput, height int) (bool, error) {
+	lockTime, sequence, ok := keyLock(out, k.pubKeyHash)
+	if !ok {
+		return false, nil
+	}
+
+	if k.state == nil {
+		state, err := newLockState(txn, k.tipHash)
+		if err != nil {
+			return false, err
+		}
+		k.state = state
+	}
+	if spendable, err := k.state.spendable(txn, lockTime, sequence, height); err != nil || !spendable {
+		return false, err
+	}
+
+	if lockTime != 0 {
+		byTime := lockTime >= LockTimeThreshold
+		if (byTime && k.heights) || (!byTime && k.times) {
+			return false, nil
+		}
+		k.heights = k.heights || !byTime
+		k.times = k.times || byTime
+	}
+
+	return true, nil
+}
+
+// pickEntry is pick for an entry of the UTXO set
+func (k *keySelector) pickEntry(txn *badger.Txn, entry UTXOEntry) (bool, error) {
+	return k.pick(txn, entry.Output, entry.Height)
+}
+
+// applyKeyLocks sets the lock time of tx and the sequences of its inputs to
+// what the outputs it spends, paid to pubKeyHash, ask for
+func applyKeyLocks(tx *Transaction, pubKeyHash []byte, prevTXs map[string]Transaction) error {
+	if err := checkPrevOutputs(tx, prevTXs); err != nil {
+		return err
+	}
+
+	for i, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+		lockTime, sequence, ok := keyLock(prevOut, pubKeyHash)
+		if !ok {
+			continue
+		}
+
+		tx.Inputs[i].Sequence = sequence
+		if lockTime > tx.LockTime {
+			tx.LockTime = lockTime
+		}
+	}
+
+	return nil
+}
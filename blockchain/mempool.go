@@ -0,0 +1,632 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+	badger "github.com/dgraph-io/badger"
+)
+
+// DefaultMaxMempoolSize is the default limit, in serialized bytes, of the
+// transactions kept in a mempool
+const DefaultMaxMempoolSize = 1 << 20
+
+// mempoolFile holds the pending transactions between runs, in the data directory
+const mempoolFile = "mempool.dat"
+
+// Mempool holds validated transactions waiting to be mined. Transactions may
+// spend outputs of the UTXO set or of other transactions in the pool, but no
+// two transactions in the pool may spend the same output.
+type Mempool struct {
+	MaxSize int
+
+	chain *Blockchain
+	mu    sync.Mutex
+	txs   map[string]*mempoolEntry
+	spent map[string]string
+	size  int
+	seq   uint64
+}
+
+type mempoolEntry struct {
+	tx   *Transaction
+	size int
+	fee  int
+	seq  uint64
+}
+
+// betterFeeRate reports whether e pays a higher fee per byte than other.
+// Entries paying the same rate are ordered by age, oldest first.
+func (e *mempoolEntry) betterFeeRate(other *mempoolEntry) bool {
+	a, b := e.fee*other.size, other.fee*e.size
+	if a != b {
+		return a > b
+	}
+
+	return e.seq < other.seq
+}
+
+func rejectTx(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrTxRejected, fmt.Sprintf(format, a...))
+}
+
+// NewMempool creates an empty mempool for chain and attaches it, so that the
+// pool follows blocks being connected and disconnected
+func NewMempool(chain *Blockchain, maxSize int) *Mempool {
+	pool := &Mempool{
+		MaxSize: maxSize,
+		chain:   chain,
+		txs:     make(map[string]*mempoolEntry),
+		spent:   make(map[string]string),
+	}
+	chain.mempool = pool
+
+	return pool
+}
+
+// AddTransaction validates tx against the UTXO set and the transactions
+// already in the pool and adds it. When the pool is full the transactions
+// paying the lowest fee rate, other than the ancestors of tx, are evicted to
+// make room, provided tx pays a higher fee rate than they do together.
+func (pool *Mempool) AddTransaction(tx *Transaction) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.addTransaction(tx)
+}
+
+func (pool *Mempool) addTransaction(tx *Transaction) error {
+	fee, err := pool.checkTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	pool.seq++
+	entry := &mempoolEntry{tx, len(tx.Serialize()), fee, pool.seq}
+	if entry.size > pool.MaxSize {
+		return rejectTx("transaction %x is larger than the mempool", tx.ID)
+	}
+	if err := pool.evict(entry, pool.ancestors(tx)); err != nil {
+		return err
+	}
+
+	pool.txs[hex.EncodeToString(tx.ID)] = entry
+	for _, in := range tx.Inputs {
+		pool.spent[outpoint(in.ID, in.Out)] = hex.EncodeToString(tx.ID)
+	}
+	pool.size += entry.size
+
+	return nil
+}
+
+// checkTransaction runs the block validation rules for a single transaction
+// on top of the current tip, treating pool transactions as confirmed, and
+// returns its fee
+func (pool *Mempool) checkTransaction(tx *Transaction) (int, error) {
+	if tx.IsCoinBase() {
+		return 0, rejectTx("coinbase transaction %x is only valid in a block", tx.ID)
+	}
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return 0, rejectTx("transaction %x has no inputs or no outputs", tx.ID)
+	}
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return 0, rejectTx("transaction %x has a wrong ID", tx.ID)
+	}
+	if _, ok := pool.txs[hex.EncodeToString(tx.ID)]; ok {
+		return 0, rejectTx("transaction %x is already in the mempool", tx.ID)
+	}
+	for _, out := range tx.Outputs {
+		if out.Value < 0 {
+			return 0, rejectTx("transaction %x has a negative output", tx.ID)
+		}
+		if !out.IsValidData() {
+			return 0, rejectTx("transaction %x has a data output over %d bytes", tx.ID, script.MaxDataCarrierSize)
+		}
+	}
+
+	var fee int
+	err := pool.chain.Database.View(func(txn *badger.Txn) error {
+		tip, err := getBlockNode(txn, pool.chain.LastHash)
+		if err != nil {
+			return err
+		}
+		lockTimeCutoff, err := medianTimePast(txn, tip)
+		if err != nil {
+			return err
+		}
+		if !tx.IsFinal(tip.Height+1, lockTimeCutoff) {
+			return rejectTx("transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+		locks := &lockState{tip, lockTimeCutoff}
+
+		prevOuts := make(map[string]TxOutput)
+		seen := make(map[string]bool)
+		inputValue := 0
+
+		for _, in := range tx.Inputs {
+			key := outpoint(in.ID, in.Out)
+			if seen[key] {
+				return rejectTx("transaction %x spends %s twice", tx.ID, key)
+			}
+			seen[key] = true
+			if spender, ok := pool.spent[key]; ok {
+				return fmt.Errorf("%w: %s is already spent by %s", ErrTxConflict, key, spender)
+			}
+
+			var output TxOutput
+			height := tip.Height + 1
+			if parent, ok := pool.txs[hex.EncodeToString(in.ID)]; ok {
+				if in.Out < 0 || in.Out >= len(parent.tx.Outputs) {
+					return rejectTx("transaction %x spends a missing output %s", tx.ID, key)
+				}
+				output = parent.tx.Outputs[in.Out]
+			} else {
+				entry, err := getUTXO(txn, in.ID, in.Out)
+				if errors.Is(err, ErrTxNotFound) {
+					return rejectTx("transaction %x spends %s, which is missing or already spent", tx.ID, key)
+				} else if err != nil {
+					return err
+				}
+				output = entry.Output
+				height = entry.Height
+			}
+
+			if reached, err := locks.sequenceReached(txn, in.Sequence, height); err != nil {
+				return err
+			} else if !reached {
+				return rejectTx("transaction %x spends %s before its relative lock %d", tx.ID, key, in.Sequence)
+			}
+
+			prevOuts[key] = output
+			inputValue += output.Value
+		}
+
+		outputValue := tx.OutputValue()
+		if outputValue > inputValue {
+			return rejectTx("transaction %x spends %d but only has %d", tx.ID, outputValue, inputValue)
+		}
+		fee = inputValue - outputValue
+
+		if err := tx.verifyScripts(prevOuts); errors.Is(err, script.ErrScriptFailed) {
+			return rejectTx("transaction %x: %v", tx.ID, err)
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	return fee, err
+}
+
+// ancestors returns the IDs of the pool transactions tx depends on, directly
+// or through other pool transactions
+func (pool *Mempool) ancestors(tx *Transaction) map[string]bool {
+	result := make(map[string]bool)
+	queue := []*Transaction{tx}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, in := range current.Inputs {
+			id := hex.EncodeToString(in.ID)
+			if parent, ok := pool.txs[id]; ok && !result[id] {
+				result[id] = true
+				queue = append(queue, parent.tx)
+			}
+		}
+	}
+
+	return result
+}
+
+// descendants returns the IDs of the pool transactions spending the outputs
+// of tx, directly or through other pool transactions
+func (pool *Mempool) descendants(tx *Transaction) map[string]bool {
+	result := make(map[string]bool)
+	queue := []*Transaction{tx}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for out := range current.Outputs {
+			if id, ok := pool.spent[outpoint(current.ID, out)]; ok && !result[id] {
+				result[id] = true
+				queue = append(queue, pool.txs[id].tx)
+			}
+		}
+	}
+
+	return result
+}
+
+// evict makes room for incoming in the pool. Transactions not listed in keep
+// are picked from the lowest fee rate up, each together with the transactions
+// spending its outputs, until incoming fits. They are only removed if incoming
+// pays a higher fee rate than all of them together; otherwise the pool is
+// left as it was.
+func (pool *Mempool) evict(incoming *mempoolEntry, keep map[string]bool) error {
+	excess := pool.size + incoming.size - pool.MaxSize
+	if excess <= 0 {
+		return nil
+	}
+
+	var candidates []*mempoolEntry
+	for id, entry := range pool.txs {
+		if !keep[id] {
+			candidates = append(candidates, entry)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[j].betterFeeRate(candidates[i])
+	})
+
+	victims := make(map[string]bool)
+	freed, fees := 0, 0
+	for _, entry := range candidates {
+		if freed >= excess {
+			break
+		}
+		id := hex.EncodeToString(entry.tx.ID)
+		if victims[id] {
+			continue
+		}
+
+		set := pool.descendants(entry.tx)
+		set[id] = true
+		for victim := range set {
+			if !victims[victim] {
+				victims[victim] = true
+				freed += pool.txs[victim].size
+				fees += pool.txs[victim].fee
+			}
+		}
+	}
+	if freed < excess || incoming.fee*freed <= fees*incoming.size {
+		return rejectTx("mempool is full")
+	}
+
+	for id := range victims {
+		if entry, ok := pool.txs[id]; ok {
+			pool.removeTransaction(entry.tx, true)
+		}
+	}
+
+	return nil
+}
+
+// removeTransaction drops tx from the pool. If descendants is set, the
+// transactions spending its outputs are removed as well.
+func (pool *Mempool) removeTransaction(tx *Transaction, descendants bool) {
+	id := hex.EncodeToString(tx.ID)
+	entry, ok := pool.txs[id]
+	if !ok {
+		return
+	}
+
+	if descendants {
+		for out := range tx.Outputs {
+			if child, ok := pool.spent[outpoint(tx.ID, out)]; ok {
+				pool.removeTransaction(pool.txs[child].tx, true)
+			}
+		}
+	}
+
+	for _, in := range tx.Inputs {
+		delete(pool.spent, outpoint(in.ID, in.Out))
+	}
+	delete(pool.txs, id)
+	pool.size -= entry.size
+}
+
+// RemoveTransaction drops the transaction with the given ID and every pool
+// transaction depending on it
+func (pool *Mempool) RemoveTransaction(txID []byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if entry, ok := pool.txs[hex.EncodeToString(txID)]; ok {
+		pool.removeTransaction(entry.tx, true)
+	}
+}
+
+// chainChanged updates the pool after a change of the main chain. Confirmed
+// transactions and those conflicting with them are removed. When blocks were
+// disconnected, their transactions are returned to the pool and every pool
+// transaction is checked again against the new tip.
+func (pool *Mempool) chainChanged(disconnected, connected []*Block) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(disconnected) == 0 {
+		for _, block := range connected {
+			pool.removeConfirmed(block)
+		}
+		return
+	}
+
+	pending := pool.transactions()
+	pool.txs = make(map[string]*mempoolEntry)
+	pool.spent = make(map[string]string)
+	pool.size = 0
+
+	var restored []*Transaction
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if !tx.IsCoinBase() {
+				restored = append(restored, tx)
+			}
+		}
+	}
+
+	for _, tx := range append(restored, pending...) {
+		// Transactions that became invalid on the new chain are dropped
+		pool.addTransaction(tx)
+	}
+}
+
+// removeConfirmed drops the transactions of a newly connected block, and the
+// pool transactions that spend the same outputs along with their descendants
+func (pool *Mempool) removeConfirmed(block *Block) {
+	for _, tx := range block.Transactions {
+		pool.removeTransaction(tx, false)
+
+		for _, in := range tx.Inputs {
+			if spender, ok := pool.spent[outpoint(in.ID, in.Out)]; ok {
+				pool.removeTransaction(pool.txs[spender].tx, true)
+			}
+		}
+	}
+}
+
+// transactions returns the pool transactions ordered by fee rate, highest
+// first. A transaction spending outputs of other pool transactions is moved
+// after them, so the result can be mined in order.
+func (pool *Mempool) transactions() []*Transaction {
+	entries := make([]*mempoolEntry, 0, len(pool.txs))
+	for _, entry := range pool.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].betterFeeRate(entries[j])
+	})
+
+	txs := make([]*Transaction, 0, len(entries))
+	added := make(map[string]bool)
+	var add func(entry *mempoolEntry)
+	add = func(entry *mempoolEntry) {
+		id := hex.EncodeToString(entry.tx.ID)
+		if added[id] {
+			return
+		}
+		added[id] = true
+
+		for _, in := range entry.tx.Inputs {
+			if parent, ok := pool.txs[hex.EncodeToString(in.ID)]; ok {
+				add(parent)
+			}
+		}
+		txs = append(txs, entry.tx)
+	}
+	for _, entry := range entries {
+		add(entry)
+	}
+
+	return txs
+}
+
+// fees returns the total fee paid by the pool transactions
+func (pool *Mempool) fees() int {
+	fees := 0
+	for _, entry := range pool.txs {
+		fees += entry.fee
+	}
+
+	return fees
+}
+
+// Transactions returns the pool transactions by fee rate, parents before
+// children
+func (pool *Mempool) Transactions() []*Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.transactions()
+}
+
+// HasTransaction reports whether the transaction with the given ID is in the pool
+func (pool *Mempool) HasTransaction(txID []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.txs[hex.EncodeToString(txID)]
+	return ok
+}
+
+// Transaction returns the pool transaction with the given ID
+func (pool *Mempool) Transaction(txID []byte) (*Transaction, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	entry, ok := pool.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+
+	return entry.tx, true
+}
+
+// FindSpendableOutputs works like UTXOSet.FindSpendableOutputs, but skips
+// outputs already spent by pool transactions and also offers the unspent
+// outputs of pool transactions, so payments can be chained before they are
+// mined
+func (pool *Mempool) FindSpendableOutputs(lockingScript []byte, amount int) (int, map[string][]int, error) {
+	return pool.findSpendableOutputs(lockedBy(lockingScript), amount)
+}
+
+// findKeyOutputs works like UTXOSet.findKeyOutputs, with the outputs of pool
+// transactions counting as mined in the next block
+func (pool *Mempool) findKeyOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	selector := &keySelector{pubKeyHash: pubKeyHash, tipHash: pool.chain.LastHash}
+
+	return pool.findSpendableOutputs(selector.pickEntry, amount)
+}
+
+func (pool *Mempool) findSpendableOutputs(pick func(*badger.Txn, UTXOEntry) (bool, error), amount int) (int, map[string][]int, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	u := UTXOSet{Blockchain: pool.chain}
+	accumulated, unspentOuts, err := u.findSpendableOutputs(pick, amount, func(txID []byte, out int) bool {
+		_, spent := pool.spent[outpoint(txID, out)]
+		return spent
+	})
+	if err != nil || accumulated >= amount {
+		return accumulated, unspentOuts, err
+	}
+
+	err = pool.chain.Database.View(func(txn *badger.Txn) error {
+		tip, err := getBlockNode(txn, pool.chain.LastHash)
+		if err != nil {
+			return err
+		}
+
+		for _, tx := range pool.transactions() {
+			for out, output := range tx.Outputs {
+				if accumulated >= amount {
+					return nil
+				}
+				if _, spent := pool.spent[outpoint(tx.ID, out)]; spent {
+					continue
+				}
+				picked, err := pick(txn, UTXOEntry{Output: output, Height: tip.Height + 1})
+				if err != nil {
+					return err
+				}
+				if picked {
+					key := hex.EncodeToString(tx.ID)
+					accumulated += output.Value
+					unspentOuts[key] = append(unspentOuts[key], out)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return accumulated, unspentOuts, err
+}
+
+// NewTransaction builds and signs a transaction paying amount to the address
+// to from the outputs of w that are not spent by the pool, including outputs
+// of pool transactions
+func (pool *Mempool) NewTransaction(w *wallet.Wallet, to string, amount int, fee Fee, lock PaymentLock) (*Transaction, error) {
+	return newTransaction(w, to, amount, fee, lock, pool.chain, pool.findKeyOutputs)
+}
+
+// NewDataTransaction works like the package function, but spends outputs
+// not spent by the pool, including outputs of pool transactions
+func (pool *Mempool) NewDataTransaction(w *wallet.Wallet, data []byte, fee Fee) (*Transaction, error) {
+	return newDataTransaction(w, data, fee, pool.chain, pool.findKeyOutputs)
+}
+
+// Count returns the number of transactions in the pool
+func (pool *Mempool) Count() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.txs)
+}
+
+// Size returns the serialized size of the pool transactions in bytes
+func (pool *Mempool) Size() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.size
+}
+
+// MineBlock mines a block on top of the tip containing every pool
+// transaction, ordered by fee rate, and a coinbase paying the block subsidy
+// plus their fees to address. The mined transactions leave the pool when the
+// block is connected.
+func (pool *Mempool) MineBlock(ctx context.Context, address string, progress func(MiningProgress)) (*Block, error) {
+	pool.mu.Lock()
+	pending := pool.transactions()
+	fees := pool.fees()
+	pool.mu.Unlock()
+
+	height, err := pool.chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	coinbase, err := CoinbaseTx(address, "", height+1, fees, pool.chain.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := append([]*Transaction{coinbase}, pending...)
+
+	return pool.chain.MineBlock(ctx, transactions, progress)
+}
+
+func (pool *Mempool) path() string {
+	return filepath.Join(pool.chain.Params.DataDir, mempoolFile)
+}
+
+// SaveFile writes the pool transactions to the data directory
+func (pool *Mempool) SaveFile() error {
+	var content bytes.Buffer
+
+	encoder := gob.NewEncoder(&content)
+	if err := encoder.Encode(pool.Transactions()); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(pool.chain.Params.DataDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(pool.path(), content.Bytes(), 0644)
+}
+
+// LoadFile adds the transactions saved by SaveFile to the pool. A missing file
+// means there are no pending transactions. Transactions that are no longer
+// valid, for example because they were mined meanwhile, are dropped.
+func (pool *Mempool) LoadFile() error {
+	fileContent, err := ioutil.ReadFile(pool.path())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var txs []*Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&txs); err != nil {
+		return err
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, tx := range txs {
+		pool.addTransaction(tx)
+	}
+
+	return nil
+}
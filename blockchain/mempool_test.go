@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// spendCoinbase returns a transaction in which w spends the 50 coinbase
+// output of block, splitting what is left after fee over outputs outputs
+func spendCoinbase(t *testing.T, chain *Blockchain, w *wallet.Wallet, block *Block, fee, outputs int) *Transaction {
+	t.Helper()
+
+	lock := script.PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))
+	tx := &Transaction{Inputs: []TxInput{{ID: block.Transactions[0].ID, Out: 0}}}
+	left := 50 - fee
+	for i := 0; i < outputs; i++ {
+		value := left / (outputs - i)
+		left -= value
+		tx.Outputs = append(tx.Outputs, TxOutput{value, lock})
+	}
+	tx.ID = tx.Hash()
+	if err := chain.SignTransaction(tx, w.PrivateKey, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func TestMempoolEvict(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+
+	var blocks []*Block
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks = append(blocks, genesis)
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, mineTransactions(t, chain, alice))
+	}
+
+	tests := []struct {
+		name      string
+		fee       int
+		wantAdded bool
+	}{
+		// Pays more than the cheaper transaction, less than both together
+		{"lower rate than the victims together", 6, false},
+		{"higher rate than the victims together", 20, true},
+	}
+	for _, tt := range tests {
+		low := spendCoinbase(t, chain, alice, blocks[0], 1, 1)
+		high := spendCoinbase(t, chain, alice, blocks[1], 10, 1)
+		incoming := spendCoinbase(t, chain, alice, blocks[2], tt.fee, 3)
+
+		// The pool holds low and high exactly, so incoming evicts both
+		pool := NewMempool(chain, len(low.Serialize())+len(high.Serialize()))
+		for _, tx := range []*Transaction{low, high} {
+			if err := pool.AddTransaction(tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(incoming.Serialize()) <= len(low.Serialize()) {
+			t.Fatal("incoming transaction fits by evicting one transaction")
+		}
+
+		err := pool.AddTransaction(incoming)
+		if tt.wantAdded {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			if pool.Count() != 1 || !pool.HasTransaction(incoming.ID) {
+				t.Errorf("%s: pool holds %d transactions, want only the incoming one", tt.name, pool.Count())
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrTxRejected) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrTxRejected)
+		}
+		if pool.Count() != 2 || !pool.HasTransaction(low.ID) || !pool.HasTransaction(high.ID) {
+			t.Errorf("%s: rejected transaction evicted others, pool holds %d", tt.name, pool.Count())
+		}
+	}
+}
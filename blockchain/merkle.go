@@ -1,6 +1,10 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
@@ -30,30 +34,94 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+// NewMerkleTree builds the tree bottom up. A level with an odd number of
+// nodes, including a single leaf, is padded by repeating its last node, so
+// data ending in a repeated run of leaves can share the root of data without
+// it. Blocks holding a transaction twice are rejected for this reason.
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
-	}
-
 	for _, dat := range data {
 		node := NewMerkleNode(nil, nil, dat)
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for {
 		var level []MerkleNode
 
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
 		for j := 0; j < len(nodes); j += 2 {
 			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
 			level = append(level, *node)
 		}
 
 		nodes = level
+		if len(nodes) == 1 {
+			break
+		}
 	}
 
 	tree := MerkleTree{&nodes[0]}
 
 	return &tree
 }
+
+// MerkleProof shows that a leaf belongs to a Merkle tree. Siblings holds the
+// hash next to the path from the leaf to the root on every level, bottom up,
+// and the bits of Index tell whether the path runs left or right of it.
+type MerkleProof struct {
+	Index    int
+	Siblings [][]byte
+}
+
+// NewMerkleProof returns the proof that data[index] is a leaf of the tree
+// NewMerkleTree builds from data
+func NewMerkleProof(data [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(data) {
+		return nil, fmt.Errorf("leaf %d is out of range of %d leaves", index, len(data))
+	}
+
+	var level []*MerkleNode
+	for _, dat := range data {
+		level = append(level, NewMerkleNode(nil, nil, dat))
+	}
+
+	proof := MerkleProof{Index: index}
+	for pos := index; ; pos /= 2 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		proof.Siblings = append(proof.Siblings, level[pos^1].Data)
+
+		var next []*MerkleNode
+		for j := 0; j < len(level); j += 2 {
+			next = append(next, NewMerkleNode(level[j], level[j+1], nil))
+		}
+
+		level = next
+		if len(level) == 1 {
+			break
+		}
+	}
+
+	return &proof, nil
+}
+
+// Verify reports whether the proof leads from the leaf data to root
+func (p *MerkleProof) Verify(data, root []byte) bool {
+	node := NewMerkleNode(nil, nil, data)
+
+	for i, sibling := range p.Siblings {
+		other := &MerkleNode{Data: sibling}
+		if p.Index>>uint(i)&1 == 0 {
+			node = NewMerkleNode(node, other, nil)
+		} else {
+			node = NewMerkleNode(other, node, nil)
+		}
+	}
+
+	return bytes.Equal(node.Data, root)
+}
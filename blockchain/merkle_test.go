@@ -0,0 +1,84 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var data [][]byte
+		for i := 0; i < n; i++ {
+			data = append(data, []byte(fmt.Sprintf("leaf %d", i)))
+		}
+		root := NewMerkleTree(data).RootNode.Data
+
+		for i := range data {
+			proof, err := NewMerkleProof(data, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proof.Verify(data[i], root) {
+				t.Errorf("proof of leaf %d of %d does not verify", i, n)
+			}
+			if proof.Verify([]byte("other leaf"), root) {
+				t.Errorf("proof of leaf %d of %d verifies other data", i, n)
+			}
+			if n > 1 && proof.Verify(data[(i+1)%n], root) {
+				t.Errorf("proof of leaf %d of %d verifies leaf %d", i, n, (i+1)%n)
+			}
+
+			tampered := *proof
+			tampered.Siblings = append([][]byte{}, proof.Siblings...)
+			tampered.Siblings[0] = bytes.Repeat([]byte{0}, len(root))
+			if tampered.Verify(data[i], root) {
+				t.Errorf("proof of leaf %d of %d verifies with a tampered sibling", i, n)
+			}
+		}
+
+		for _, i := range []int{-1, n} {
+			if _, err := NewMerkleProof(data, i); err == nil {
+				t.Errorf("proof of leaf %d of %d was built", i, n)
+			}
+		}
+	}
+}
+
+func TestBlockMerkleProof(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+
+	var txs []*Transaction
+	pool := NewMempool(chain, DefaultMaxMempoolSize)
+	for i := 0; i < 4; i++ {
+		tx, err := pool.NewTransaction(alice, addressOn(chain, wallet.CreateWallet()), 5, Fee{}, PaymentLock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pool.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	block := mineTransactions(t, chain, alice, txs...)
+
+	for _, tx := range block.Transactions {
+		proof, err := block.MerkleProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proof.Verify(tx.ID, block.MerkleRoot) {
+			t.Errorf("proof of %x does not verify against the block", tx.ID)
+		}
+		if proof.Verify(tx.ID, block.WitnessRoot) {
+			t.Errorf("proof of %x verifies against the witness root", tx.ID)
+		}
+	}
+	if _, err := block.MerkleProof([]byte("unknown")); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("proof of an unknown transaction: got %v, want %v", err, ErrTxNotFound)
+	}
+}
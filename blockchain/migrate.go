@@ -0,0 +1,286 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	badger "github.com/dgraph-io/badger"
+)
+
+// legacyBlock decodes a stored block of any database version. Gob matches
+// fields by name, so it lists the fields of every layout: the header fields
+// of the first layout sat in the block itself. Bits and Nonce changed type
+// and are decoded apart by legacyNumbers.
+type legacyBlock struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	Nonce         int
+	BlockHeader   legacyHeader
+	Transactions  []*legacyTransaction
+	Hash          []byte
+}
+
+type legacyHeader struct {
+	Version       int
+	Height        int
+	PrevBlockHash []byte
+	MerkleRoot    []byte
+	WitnessRoot   []byte
+	Timestamp     int64
+}
+
+// legacyTransaction holds the inputs and outputs of every layout: before
+// locking scripts an input carried Signature and PubKey and an output
+// PubKeyHash
+type legacyTransaction struct {
+	ID       []byte
+	Inputs   []legacyInput
+	Outputs  []legacyOutput
+	LockTime int64
+}
+
+type legacyInput struct {
+	ID              []byte
+	Out             int
+	Signature       []byte
+	PubKey          []byte
+	UnlockingScript []byte
+	Sequence        uint32
+}
+
+type legacyOutput struct {
+	Value         int
+	PubKeyHash    []byte
+	LockingScript []byte
+}
+
+// legacyNumbers returns the bits and nonce of a stored block. Until compact
+// bits, both were ints and Bits counted the leading zero bits of the target.
+// ok is false for blocks without a header, which used the PoW limit.
+func legacyNumbers(data []byte) (bits, nonce uint32, ok bool) {
+	var current struct{ BlockHeader struct{ Bits, Nonce uint32 } }
+	if gobDecode(data, &current) == nil && current.BlockHeader.Bits != 0 {
+		return current.BlockHeader.Bits, current.BlockHeader.Nonce, true
+	}
+
+	var compact struct{ BlockHeader struct{ Bits uint32 } }
+	if gobDecode(data, &compact) == nil && compact.BlockHeader.Bits != 0 {
+		var n struct{ BlockHeader struct{ Nonce int } }
+		gobDecode(data, &n)
+		return compact.BlockHeader.Bits, uint32(n.BlockHeader.Nonce), true
+	}
+
+	var zeroBits struct{ BlockHeader struct{ Bits, Nonce int } }
+	if gobDecode(data, &zeroBits) == nil && zeroBits.BlockHeader.Bits != 0 {
+		target := new(big.Int).Lsh(big.NewInt(1), uint(256-zeroBits.BlockHeader.Bits))
+		return BigToCompact(target), uint32(zeroBits.BlockHeader.Nonce), true
+	}
+
+	return 0, 0, false
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// decodeLegacyBlock converts a block stored by any database version to the
+// current layout. Its hash and transaction IDs are kept as they were, so the
+// chain and the outputs it spends still link up, even though neither can be
+// recomputed from the converted block.
+func (chain *Blockchain) decodeLegacyBlock(data []byte) (*Block, error) {
+	var old legacyBlock
+	if err := gobDecode(data, &old); err != nil {
+		return nil, err
+	}
+
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:       old.BlockHeader.Version,
+			Height:        old.BlockHeader.Height,
+			PrevBlockHash: old.BlockHeader.PrevBlockHash,
+			MerkleRoot:    old.BlockHeader.MerkleRoot,
+			WitnessRoot:   old.BlockHeader.WitnessRoot,
+			Timestamp:     old.BlockHeader.Timestamp,
+			Bits:          chain.Params.PowLimitBits,
+			Nonce:         uint32(old.Nonce),
+		},
+		Hash: old.Hash,
+	}
+	if bits, nonce, ok := legacyNumbers(data); ok {
+		block.Bits, block.Nonce = bits, nonce
+	} else {
+		block.PrevBlockHash = old.PrevBlockHash
+		block.Timestamp = old.Timestamp
+	}
+
+	for _, oldTx := range old.Transactions {
+		tx := &Transaction{ID: oldTx.ID, LockTime: oldTx.LockTime}
+		for _, in := range oldTx.Inputs {
+			input := TxInput{ID: in.ID, Out: in.Out, UnlockingScript: in.UnlockingScript, Sequence: in.Sequence}
+			if in.UnlockingScript == nil && len(in.ID) == 0 && in.Out == -1 {
+				// Coinbase data used to be kept in PubKey
+				input.UnlockingScript = in.PubKey
+			} else if in.UnlockingScript == nil {
+				input.UnlockingScript = script.UnlockPubKeyHash(in.Signature, in.PubKey)
+			}
+			tx.Inputs = append(tx.Inputs, input)
+		}
+		for _, out := range oldTx.Outputs {
+			output := TxOutput{Value: out.Value, LockingScript: out.LockingScript}
+			if out.LockingScript == nil {
+				output.LockingScript = script.PayToPubKeyHash(out.PubKeyHash)
+			}
+			tx.Outputs = append(tx.Outputs, output)
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	return block, nil
+}
+
+// migrate upgrades a database written by an older version. The main chain
+// is read back from the tip and every block is rewritten in the current
+// layout, and the block index, height index, transaction index, UTXO set and
+// undo records are rebuilt from them. Side branches are dropped. Until the
+// new version is stored at the end, the migration can be run again.
+func (chain *Blockchain) migrate() error {
+	var version int
+	var hashes [][]byte
+	mainChain := make(map[string]bool)
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		version, err = getDBVersion(txn)
+		return err
+	})
+	if err != nil || version == dbVersion {
+		return err
+	}
+	if version > dbVersion {
+		return fmt.Errorf("database version %d is newer than supported version %d", version, dbVersion)
+	}
+
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		for hash := chain.LastHash; len(hash) > 0; {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return fmt.Errorf("reading block %x: %w", hash, err)
+			}
+			data, err := item.Value()
+			if err != nil {
+				return err
+			}
+			block, err := chain.decodeLegacyBlock(data)
+			if err != nil {
+				return fmt.Errorf("decoding block %x: %w", hash, err)
+			}
+			hashes = append([][]byte{hash}, hashes...)
+			mainChain[string(hash)] = true
+			hash = block.PrevBlockHash
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := chain.dropSideBranches(mainChain); err != nil {
+		return err
+	}
+	for _, prefix := range [][]byte{blockIndexPrefix, heightPrefix, txIndexPrefix, utxoPrefix, undoPrefix} {
+		if err := deleteByPrefix(chain.Database, prefix); err != nil {
+			return err
+		}
+	}
+
+	var parent *BlockNode
+	for height, hash := range hashes {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			data, err := item.Value()
+			if err != nil {
+				return err
+			}
+			block, err := chain.decodeLegacyBlock(data)
+			if err != nil {
+				return err
+			}
+			block.Height = height
+
+			node := &BlockNode{
+				Hash:      block.Hash,
+				PrevHash:  block.PrevBlockHash,
+				Height:    height,
+				Bits:      block.Bits,
+				Timestamp: block.Timestamp,
+				ChainWork: CalcWork(block.Bits),
+			}
+			if parent != nil {
+				node.ChainWork.Add(node.ChainWork, parent.ChainWork)
+			}
+			parent = node
+
+			if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+				return err
+			}
+			if err := putBlockNode(txn, node); err != nil {
+				return err
+			}
+			if err := txn.Set(heightKey(height), block.Hash); err != nil {
+				return err
+			}
+			if err := indexTransactions(txn, block); err != nil {
+				return err
+			}
+
+			return updateUTXO(txn, block)
+		})
+		if err != nil {
+			return fmt.Errorf("migrating block %x: %w", hash, err)
+		}
+	}
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		return setDBVersion(txn, dbVersion)
+	})
+}
+
+// dropSideBranches deletes the stored blocks that the block index knows of
+// but that are not in mainChain
+func (chain *Blockchain) dropSideBranches(mainChain map[string]bool) error {
+	var side [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(blockIndexPrefix); it.ValidForPrefix(blockIndexPrefix); it.Next() {
+			hash := it.Item().KeyCopy(nil)[len(blockIndexPrefix):]
+			if !mainChain[string(hash)] {
+				side = append(side, hash)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		for _, hash := range side {
+			if err := txn.Delete(hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+	badger "github.com/dgraph-io/badger"
+)
+
+// Each database in testdata holds the same chain, written by the last code to
+// use its version: a genesis block paying key A, a block in which A pays B
+// 20 and one in which B pays A 5. Each block rewards the payer. The version 4
+// database also indexes its transactions.
+const (
+	legacyAddressA = "16GhmYzUwYZBhhqjFcgQXKAjbfnGwpRNVG"
+	legacyAddressB = "16bqZcXXQwMyyD6tjfxDW4JjqaPodXNceJ"
+)
+
+// legacyWallet returns the key the fixture derived from seed
+func legacyWallet(seed string) *wallet.Wallet {
+	curve := elliptic.P256()
+	hash := sha256.Sum256([]byte(seed))
+	d := new(big.Int).SetBytes(hash[:])
+	d.Mod(d, curve.Params().N)
+
+	private := ecdsa.PrivateKey{D: d}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+
+	return &wallet.Wallet{PrivateKey: private, PublicKey: wallet.EncodePublicKey(&private.PublicKey)}
+}
+
+// openFixture copies the database in testdata/name to a temporary directory
+// and returns mainnet parameters pointing at it, since the first version knew
+// no other network
+func openFixture(t *testing.T, name string) (*chaincfg.ChainParams, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := chaincfg.MainNetParams
+	params.DataDir = dir
+
+	src := filepath.Join("testdata", name, "blocks")
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dbPath(&params), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(src, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dbPath(&params), file.Name()), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &params, func() { os.RemoveAll(dir) }
+}
+
+func checkBalances(t *testing.T, chain *Blockchain, want map[string]int) {
+	t.Helper()
+
+	u := UTXOSet{chain}
+	for address, value := range want {
+		spendable, _, err := u.Balance(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spendable != value {
+			t.Errorf("balance of %s = %d, want %d", address, spendable, value)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, fixture := range []string{"v1", "v4"} {
+		t.Run(fixture, func(t *testing.T) {
+			testMigrate(t, fixture)
+		})
+	}
+}
+
+func testMigrate(t *testing.T, fixture string) {
+	params, cleanup := openFixture(t, fixture)
+	defer cleanup()
+
+	alice, bob := legacyWallet("baseline key A"), legacyWallet("baseline key B")
+	if got := string(alice.Address(params.AddressVersion)); got != legacyAddressA {
+		t.Fatalf("key A has address %s, want %s", got, legacyAddressA)
+	}
+	if got := string(bob.Address(params.AddressVersion)); got != legacyAddressB {
+		t.Fatalf("key B has address %s, want %s", got, legacyAddressB)
+	}
+
+	chain, err := ContinueBlockchain(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { chain.Database.Close() }()
+
+	var version int
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		version, err = getDBVersion(txn)
+		return err
+	})
+	if err != nil || version != dbVersion {
+		t.Fatalf("migrated database has version %d, %v; want %d", version, err, dbVersion)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 2 {
+		t.Fatalf("migrated chain has height %d, %v; want 2", height, err)
+	}
+	checkBalances(t, chain, map[string]int{legacyAddressA: 85, legacyAddressB: 65})
+
+	block, err := chain.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range block.Transactions {
+		if _, err := chain.FindTransaction(tx.ID); err != nil {
+			t.Errorf("transaction %x of block 1: %v", tx.ID, err)
+		}
+	}
+	if fixture == "v4" {
+		err := chain.Database.View(func(txn *badger.Txn) error {
+			_, err := txn.Get(txIndexEntryKey(block.Transactions[1].ID))
+			return err
+		})
+		if err != nil {
+			t.Errorf("transaction index was not rebuilt: %v", err)
+		}
+	}
+
+	// The migrated outputs can be spent by the current code
+	u := UTXOSet{chain}
+	tx, err := NewTransaction(bob, legacyAddressA, 60, Fee{}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain, bob, tx)
+	checkBalances(t, chain, map[string]int{legacyAddressA: 145, legacyAddressB: 55})
+
+	// Opening the migrated database again leaves it as it is
+	chain.Database.Close()
+	if chain, err = ContinueBlockchain(params); err != nil {
+		t.Fatal(err)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 3 {
+		t.Fatalf("reopened chain has height %d, %v; want 3", height, err)
+	}
+	checkBalances(t, chain, map[string]int{legacyAddressA: 145, legacyAddressB: 55})
+}
@@ -0,0 +1,173 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// NewMultiSigTransaction builds an unsigned transaction paying amount to the
+// address to from confirmed outputs locked to the multisig redeemScript, by
+// script hash or, if bare is set, directly. Change returns to the same script.
+// The parties then add their signatures with SignMultiSig until enough are in.
+func NewMultiSigTransaction(redeemScript []byte, bare bool, to string, amount, fee int, u *UTXOSet) (*Transaction, error) {
+	return newMultiSigTransaction(redeemScript, bare, to, amount, fee, u.Blockchain, u.FindSpendableOutputs)
+}
+
+func newMultiSigTransaction(redeemScript []byte, bare bool, to string, amount, fee int, chain *Blockchain, findSpendable func([]byte, int) (int, map[string][]int, error)) (*Transaction, error) {
+	if amount <= 0 || fee < 0 {
+		return nil, fmt.Errorf("invalid amount %d or fee %d", amount, fee)
+	}
+	if _, _, ok := script.ExtractMultiSig(redeemScript); !ok {
+		return nil, fmt.Errorf("not a multisig script: %s", script.DisassembleString(redeemScript))
+	}
+
+	lockingScript := redeemScript
+	if !bare {
+		lockingScript = script.PayToScriptHash(wallet.PublicKeyHash(redeemScript))
+	}
+
+	acc, validOutputs, err := findSpendable(lockingScript, amount+fee)
+	if err != nil {
+		return nil, err
+	}
+	if acc < amount+fee {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, acc, amount+fee)
+	}
+
+	inputs, err := spendInputs(validOutputs)
+	if err != nil {
+		return nil, err
+	}
+	// The redeem script stays in the unlocking script while signatures are
+	// collected, so signers need nothing but the transaction
+	if !bare {
+		for i := range inputs {
+			inputs[i].UnlockingScript = script.UnlockScriptHash(nil, redeemScript)
+		}
+	}
+
+	payment, err := NewTxOutput(amount, to, chain.Params)
+	if err != nil {
+		return nil, err
+	}
+	outputs := []TxOutput{*payment}
+	if acc > amount+fee {
+		outputs = append(outputs, TxOutput{acc - amount - fee, lockingScript})
+	}
+
+	tx := Transaction{Inputs: inputs, Outputs: outputs}
+	tx.ID = tx.Hash()
+
+	return &tx, nil
+}
+
+// NewMultiSigTransaction works like the package function, but spends outputs
+// not spent by the pool, including outputs of pool transactions
+func (pool *Mempool) NewMultiSigTransaction(redeemScript []byte, bare bool, to string, amount, fee int) (*Transaction, error) {
+	return newMultiSigTransaction(redeemScript, bare, to, amount, fee, pool.chain, pool.FindSpendableOutputs)
+}
+
+// SignMultiSig adds the signature of privateKey with hashType to every input
+// of tx that spends a multisig output, bare or by script hash, listing its
+// public key. Signatures already present are kept, ordered by the keys that
+// made them, so the parties may sign in any order. It returns the number of
+// inputs signed.
+func (tx *Transaction) SignMultiSig(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType SigHashType) (int, error) {
+	if err := checkPrevOutputs(tx, prevTXs); err != nil {
+		return 0, err
+	}
+
+	pubKey := wallet.EncodePublicKey(&privateKey.PublicKey)
+	signed := 0
+
+	for inId, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+		redeemScript, sigs, err := multiSigInput(in, prevOut)
+		if err != nil {
+			return signed, fmt.Errorf("input %d: %w", inId, err)
+		}
+		if redeemScript == nil {
+			continue
+		}
+
+		required, pubKeys, _ := script.ExtractMultiSig(redeemScript)
+
+		keySigs := make([][]byte, len(pubKeys))
+		key := -1
+		for k, pk := range pubKeys {
+			if bytes.Equal(pk, pubKey) {
+				key = k
+			}
+			for _, sig := range sigs {
+				if tx.checkSignature(inId, redeemScript, pk, sig) {
+					keySigs[k] = sig
+					break
+				}
+			}
+		}
+		if key < 0 {
+			continue
+		}
+
+		if keySigs[key] == nil {
+			if keySigs[key], err = tx.SignInput(inId, redeemScript, privateKey, hashType); err != nil {
+				return signed, err
+			}
+		}
+		signed++
+
+		var ordered [][]byte
+		for _, sig := range keySigs {
+			if sig != nil && len(ordered) < required {
+				ordered = append(ordered, sig)
+			}
+		}
+
+		unlocking := script.UnlockMultiSig(ordered)
+		if !bytes.Equal(redeemScript, prevOut.LockingScript) {
+			unlocking = script.UnlockScriptHash(unlocking, redeemScript)
+		}
+		tx.Inputs[inId].UnlockingScript = unlocking
+	}
+	tx.ID = tx.Hash()
+
+	return signed, nil
+}
+
+// multiSigInput returns the multisig script an input spending prevOut has to
+// satisfy and the signatures its unlocking script holds so far. The script is
+// nil if prevOut is not a bare or a pay-to-script-hash multisig output.
+func multiSigInput(in TxInput, prevOut TxOutput) ([]byte, [][]byte, error) {
+	items, err := script.PushedData(in.UnlockingScript)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, _, ok := script.ExtractMultiSig(prevOut.LockingScript); ok {
+		return prevOut.LockingScript, items, nil
+	}
+
+	scriptHash := script.ExtractScriptHash(prevOut.LockingScript)
+	if scriptHash == nil {
+		return nil, nil, nil
+	}
+	if len(items) == 0 {
+		return nil, nil, errors.New("unlocking script does not hold the redeem script")
+	}
+
+	redeemScript := items[len(items)-1]
+	if !bytes.Equal(wallet.PublicKeyHash(redeemScript), scriptHash) {
+		return nil, nil, errors.New("redeem script does not match the script hash")
+	}
+	if _, _, ok := script.ExtractMultiSig(redeemScript); !ok {
+		return nil, nil, nil
+	}
+
+	return redeemScript, items[:len(items)-1], nil
+}
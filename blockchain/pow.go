@@ -2,25 +2,47 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"fmt"
 	"math"
 	"math/big"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const targetBits = 16
+// defaultProgressInterval is how often a running miner reports progress
+const defaultProgressInterval = time.Second
+
+// MiningProgress is passed to the progress callback while a block is mined
+type MiningProgress struct {
+	Hashes   uint64
+	Elapsed  time.Duration
+	HashRate float64
+}
 
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int
+
+	// Workers is the number of goroutines searching the nonce space.
+	// Progress, when set, is called every ProgressInterval while mining.
+	Workers          int
+	Progress         func(MiningProgress)
+	ProgressInterval time.Duration
 }
 
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target := CompactToBig(b.Bits)
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{
+		Block:            b,
+		Target:           target,
+		Workers:          runtime.NumCPU(),
+		ProgressInterval: defaultProgressInterval,
+	}
 
 	return pow
 }
@@ -30,13 +52,16 @@ func IntToHex(n int64) []byte {
 }
 
 // Data preparation
-func (pow *ProofOfWork) prepareData(nonce int) []byte {
+func (pow *ProofOfWork) prepareData(nonce uint32) []byte {
 	data := bytes.Join(
 		[][]byte{
+			IntToHex(int64(pow.Block.Version)),
+			IntToHex(int64(pow.Block.Height)),
 			pow.Block.PrevBlockHash,
-			pow.Block.HashTransactions(),
+			pow.Block.MerkleRoot,
+			pow.Block.WitnessRoot,
 			IntToHex(pow.Block.Timestamp),
-			IntToHex(int64(targetBits)),
+			IntToHex(int64(pow.Block.Bits)),
 			IntToHex(int64(nonce)),
 		},
 		[]byte{},
@@ -44,39 +69,131 @@ func (pow *ProofOfWork) prepareData(nonce int) []byte {
 	return data
 }
 
-// Init ProofOfWork algorithm
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
+// Run mines the block, splitting the nonce space between Workers goroutines.
+// When every nonce has been tried the timestamp is bumped and the search
+// starts over. On success the nonce and hash are set on the block; if ctx is
+// cancelled first, its error is returned and the block is left unsolved.
+func (pow *ProofOfWork) Run(ctx context.Context) error {
+	var hashes uint64
+	start := time.Now()
+
+	report := func() {
+		if pow.Progress == nil {
+			return
+		}
+		elapsed := time.Since(start)
+		done := atomic.LoadUint64(&hashes)
+		pow.Progress(MiningProgress{done, elapsed, float64(done) / elapsed.Seconds()})
+	}
 
-	// fmt.Printf("Mining block containing \"%s\"n", pow.Block.Transactions)
+	for {
+		found, err := pow.search(ctx, &hashes, report)
+		if err != nil {
+			return err
+		}
+		if found {
+			report()
+			return nil
+		}
 
-	for nonce < math.MaxInt64 {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash)
-		hashInt.SetBytes(hash[:])
+		pow.Block.Timestamp++
+	}
+}
 
-		if hashInt.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
+// search tries every nonce once for the current header. It reports whether a
+// solution was found.
+func (pow *ProofOfWork) search(ctx context.Context, hashes *uint64, report func()) (bool, error) {
+	workers := pow.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	solutions := make(chan uint32, workers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			var hashInt big.Int
+			var tried uint64
+
+			defer func() { atomic.AddUint64(hashes, tried%1024) }()
+
+			for nonce := first; nonce <= math.MaxUint32; nonce += uint64(workers) {
+				if tried++; tried%1024 == 0 {
+					atomic.AddUint64(hashes, 1024)
+					if searchCtx.Err() != nil {
+						return
+					}
+				}
+
+				hash := sha256.Sum256(pow.prepareData(uint32(nonce)))
+				hashInt.SetBytes(hash[:])
+
+				if hashInt.Cmp(pow.Target) == -1 {
+					solutions <- uint32(nonce)
+					cancel()
+					return
+				}
+			}
+		}(uint64(w))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	interval := pow.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+wait:
+	for {
+		select {
+		case <-ticker.C:
+			report()
+		case <-done:
+			break wait
 		}
 	}
 
-	fmt.Printf("\n\n")
+	select {
+	case nonce := <-solutions:
+		pow.Block.Nonce = nonce
+		pow.Block.Hash = pow.Hash()
+		return true, nil
+	default:
+	}
 
-	return nonce, hash[:]
+	return false, ctx.Err()
 }
 
-// Validation of ProofOfWork hash returns isValid result
-func (pow *ProofOfWork) Validate() bool {
+// Hash recomputes the block hash from its contents and nonce
+func (pow *ProofOfWork) Hash() []byte {
+	hash := sha256.Sum256(pow.prepareData(pow.Block.Nonce))
+
+	return hash[:]
+}
+
+// Validate checks that the block has the difficulty the chain requires at
+// its height and that its hash meets the target
+func (pow *ProofOfWork) Validate(requiredBits uint32) bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.Block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
+	if pow.Block.Bits != requiredBits || pow.Target.Sign() <= 0 {
+		return false
+	}
+
+	hashInt.SetBytes(pow.Hash())
 
 	isValid := hashInt.Cmp(pow.Target) == -1
 
@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+)
+
+func TestProofOfWorkRun(t *testing.T) {
+	bits := chaincfg.RegTestParams.PowLimitBits
+	block := newBlock(time.Now().Unix(), []*Transaction{{ID: []byte("tx")}}, []byte("parent"), 1, bits)
+
+	pow := NewProofOfWork(block)
+	pow.Workers = 4
+	if err := pow.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !pow.Validate(bits) {
+		t.Errorf("mined block %x does not validate", block.Hash)
+	}
+}
+
+func TestProofOfWorkCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{"cancelled while mining", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"cancelled before mining", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled},
+		{"deadline passed", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		goroutines := runtime.NumGoroutine()
+
+		// No hash is below a zero target
+		block := newBlock(time.Now().Unix(), []*Transaction{{ID: []byte("tx")}}, []byte("parent"), 1, 0)
+		pow := NewProofOfWork(block)
+		pow.Target = big.NewInt(0)
+		pow.Workers = 4
+		pow.ProgressInterval = 5 * time.Millisecond
+		var reports int64
+		pow.Progress = func(MiningProgress) { atomic.AddInt64(&reports, 1) }
+
+		ctx, cancel := tt.ctx()
+		done := make(chan error)
+		go func() { done <- pow.Run(ctx) }()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: Run = %v, want %v", tt.name, err, tt.want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: Run did not stop", tt.name)
+		}
+		cancel()
+
+		if block.Hash != nil || block.Nonce != 0 {
+			t.Errorf("%s: unsolved block got nonce %d and hash %x", tt.name, block.Nonce, block.Hash)
+		}
+
+		// Every worker and the progress ticker are gone once Run returns
+		reported := atomic.LoadInt64(&reports)
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > goroutines {
+			t.Errorf("%s: %d goroutines left running, %d before mining", tt.name, n, goroutines)
+		}
+		time.Sleep(4 * pow.ProgressInterval)
+		if again := atomic.LoadInt64(&reports); again != reported {
+			t.Errorf("%s: progress reported %d times after Run returned", tt.name, again-reported)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// PartialTransaction carries an unsigned transaction from the node that
+// builds it to the holders of the keys that sign it. It holds the
+// transactions whose outputs it spends, so signers need neither the chain nor
+// a node, and the signatures collected so far, so copies signed apart can be
+// combined.
+type PartialTransaction struct {
+	Tx     Transaction
+	Inputs []PartialInput
+}
+
+// PartialInput holds what the signers of an input need and the signatures
+// they made. PrevTx is the whole transaction the input spends from, rather
+// than the spent output alone, so signers can check it against the input ID
+// before trusting its value. Signatures are keyed by the hex encoded public
+// key that made them. RedeemScript is set for inputs spending
+// pay-to-script-hash outputs.
+type PartialInput struct {
+	PrevTx       Transaction
+	RedeemScript []byte
+	Signatures   map[string][]byte
+}
+
+// NewPartialTransaction wraps tx, which spends outputs of prevTXs, for
+// signing. Unlocking scripts are dropped, but the redeem scripts and the
+// multisig signatures they hold are kept.
+func NewPartialTransaction(tx *Transaction, prevTXs map[string]Transaction) (*PartialTransaction, error) {
+	if tx.IsCoinBase() {
+		return nil, errors.New("coinbase transactions can not be signed")
+	}
+	if err := checkPrevOutputs(tx, prevTXs); err != nil {
+		return nil, err
+	}
+
+	pt := PartialTransaction{Tx: Transaction{Outputs: tx.Outputs, LockTime: tx.LockTime}}
+	for _, in := range tx.Inputs {
+		pt.Tx.Inputs = append(pt.Tx.Inputs, TxInput{ID: in.ID, Out: in.Out, Sequence: in.Sequence})
+	}
+	pt.Tx.ID = pt.Tx.Hash()
+
+	for inId, in := range tx.Inputs {
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		prevOut := prevTx.Outputs[in.Out]
+		input := PartialInput{PrevTx: prevTx, Signatures: make(map[string][]byte)}
+
+		if script.IsPayToScriptHash(prevOut.LockingScript) {
+			if items, err := script.PushedData(in.UnlockingScript); err == nil && len(items) > 0 {
+				input.RedeemScript = items[len(items)-1]
+			}
+		}
+		if redeemScript, sigs, err := multiSigInput(in, prevOut); err == nil && redeemScript != nil {
+			_, pubKeys, _ := script.ExtractMultiSig(redeemScript)
+			for _, pubKey := range pubKeys {
+				for _, sig := range sigs {
+					if tx.checkSignature(inId, redeemScript, pubKey, sig) {
+						input.Signatures[hex.EncodeToString(pubKey)] = sig
+					}
+				}
+			}
+		}
+
+		pt.Inputs = append(pt.Inputs, input)
+	}
+
+	return &pt, nil
+}
+
+// CreatePartialTransaction builds an unsigned transaction paying amount to
+// the address to, under lock, from the confirmed outputs of the key address
+// from, like NewTransaction does without the private key
+func CreatePartialTransaction(from, to string, amount int, fee Fee, lock PaymentLock, u *UTXOSet) (*PartialTransaction, error) {
+	return createPartialTransaction(from, to, amount, fee, lock, u.Blockchain, u.findKeyOutputs)
+}
+
+func createPartialTransaction(from, to string, amount int, fee Fee, lock PaymentLock, chain *Blockchain, findSpendable func([]byte, int) (int, map[string][]int, error)) (*PartialTransaction, error) {
+	if !wallet.ValidateAddress(from, chain.Params.AddressVersion) {
+		return nil, fmt.Errorf("%s is not a key address", from)
+	}
+	if amount <= 0 || fee.Amount < 0 || fee.Rate < 0 {
+		return nil, fmt.Errorf("invalid amount %d or fee %d", amount, fee.Amount)
+	}
+
+	payment, err := lock.output(amount, to, chain.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fees by rate are sized with unlocking scripts as large as the signed
+	// ones, which NewPartialTransaction drops again
+	placeholder := script.UnlockPubKeyHash(make([]byte, wallet.SignatureLength+1), make([]byte, wallet.PublicKeyLength))
+	var prevTXs map[string]Transaction
+	tx, err := fundTransaction(fee, func(fee int) (*Transaction, error) {
+		tx, prev, err := assembleTransaction(wallet.AddressHash(from), *payment, fee, chain, findSpendable)
+		if err != nil {
+			return nil, err
+		}
+		for i := range tx.Inputs {
+			tx.Inputs[i].UnlockingScript = placeholder
+		}
+		tx.ID = tx.Hash()
+		prevTXs = prev
+		return tx, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPartialTransaction(tx, prevTXs)
+}
+
+// CreatePartialTransaction works like the package function, but spends
+// outputs not spent by the pool, including outputs of pool transactions
+func (pool *Mempool) CreatePartialTransaction(from, to string, amount int, fee Fee, lock PaymentLock) (*PartialTransaction, error) {
+	return createPartialTransaction(from, to, amount, fee, lock, pool.chain, pool.findKeyOutputs)
+}
+
+func (pt *PartialTransaction) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	err := gob.NewEncoder(&encoded).Encode(pt)
+	HandleErr(err)
+
+	return encoded.Bytes()
+}
+
+func DeserializePartialTransaction(data []byte) (*PartialTransaction, error) {
+	var pt PartialTransaction
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&pt); err != nil {
+		return nil, err
+	}
+	if err := pt.checkPrevTransactions(); err != nil {
+		return nil, err
+	}
+	for i := range pt.Inputs {
+		if pt.Inputs[i].Signatures == nil {
+			pt.Inputs[i].Signatures = make(map[string][]byte)
+		}
+	}
+
+	return &pt, nil
+}
+
+// checkPrevTransactions checks that every input comes with the transaction it
+// spends from, hashing to the input ID, and that this transaction has the
+// spent output
+func (pt *PartialTransaction) checkPrevTransactions() error {
+	if len(pt.Inputs) != len(pt.Tx.Inputs) {
+		return fmt.Errorf("partial transaction has %d inputs but describes %d", len(pt.Tx.Inputs), len(pt.Inputs))
+	}
+
+	for i, in := range pt.Tx.Inputs {
+		prevTx := &pt.Inputs[i].PrevTx
+		if !bytes.Equal(prevTx.Hash(), in.ID) {
+			return fmt.Errorf("input %d: previous transaction is not %x", i, in.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return fmt.Errorf("input %d spends output %d of a transaction with %d outputs", i, in.Out, len(prevTx.Outputs))
+		}
+	}
+
+	return nil
+}
+
+// prevOutput returns the output spent by input in
+func (pt *PartialTransaction) prevOutput(in int) TxOutput {
+	return pt.Inputs[in].PrevTx.Outputs[pt.Tx.Inputs[in].Out]
+}
+
+// Fee returns the value of the spent outputs that the outputs leave over
+func (pt *PartialTransaction) Fee() int {
+	inputValue := 0
+	for inId := range pt.Inputs {
+		inputValue += pt.prevOutput(inId).Value
+	}
+
+	return inputValue - pt.Tx.OutputValue()
+}
+
+// signScript returns the script the signatures of input in commit to: the
+// locking script of the spent output or, for pay-to-script-hash, the redeem
+// script
+func (pt *PartialTransaction) signScript(in int) ([]byte, error) {
+	input := pt.Inputs[in]
+	prevOut := pt.prevOutput(in)
+
+	scriptHash := script.ExtractScriptHash(prevOut.LockingScript)
+	if scriptHash == nil {
+		return prevOut.LockingScript, nil
+	}
+	if input.RedeemScript == nil {
+		return nil, fmt.Errorf("input %d lacks the redeem script", in)
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(input.RedeemScript), scriptHash) {
+		return nil, fmt.Errorf("input %d: redeem script does not match the script hash", in)
+	}
+
+	return input.RedeemScript, nil
+}
+
+// canSign reports whether the key pubKey alone or as one of a multisig signs
+// subScript
+func canSign(subScript, pubKey []byte) bool {
+	if _, _, ok := keyLock(TxOutput{LockingScript: subScript}, wallet.PublicKeyHash(pubKey)); ok {
+		return true
+	}
+
+	_, pubKeys, _ := script.ExtractMultiSig(subScript)
+	for _, key := range pubKeys {
+		if bytes.Equal(key, pubKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sign adds the signatures with hashType of every key of wallets to the
+// inputs that key can sign: key, time-lock and sequence-lock outputs of its
+// address and multisig outputs listing it. It needs no chain, but refuses to
+// sign unless the previous transactions match the inputs, so the fee it
+// signs for is the one Fee shows. It returns the number of inputs signed.
+func (pt *PartialTransaction) Sign(wallets *wallet.Wallets, hashType SigHashType) (int, error) {
+	if err := pt.checkPrevTransactions(); err != nil {
+		return 0, err
+	}
+
+	addresses := wallets.GetAllAddresses()
+	sort.Strings(addresses)
+
+	signed := 0
+	for inId := range pt.Inputs {
+		subScript, err := pt.signScript(inId)
+		if err != nil {
+			return signed, err
+		}
+
+		signedInput := false
+		for _, address := range addresses {
+			w := wallets.Wallets[address]
+			if !canSign(subScript, w.PublicKey) {
+				continue
+			}
+
+			sig, err := pt.Tx.SignInput(inId, subScript, w.PrivateKey, hashType)
+			if err != nil {
+				return signed, err
+			}
+			pt.Inputs[inId].Signatures[hex.EncodeToString(w.PublicKey)] = sig
+			signedInput = true
+		}
+		if signedInput {
+			signed++
+		}
+	}
+
+	return signed, nil
+}
+
+// Combine adds the signatures of other, a copy of the same transaction
+// signed apart, to pt
+func (pt *PartialTransaction) Combine(other *PartialTransaction) error {
+	if !bytes.Equal(pt.Tx.Hash(), other.Tx.Hash()) || len(pt.Inputs) != len(other.Inputs) {
+		return errors.New("partial transactions spend or pay differently")
+	}
+	if err := other.checkPrevTransactions(); err != nil {
+		return err
+	}
+
+	for i, input := range other.Inputs {
+		if pt.Inputs[i].RedeemScript == nil {
+			pt.Inputs[i].RedeemScript = input.RedeemScript
+		}
+		for pubKey, sig := range input.Signatures {
+			pt.Inputs[i].Signatures[pubKey] = sig
+		}
+	}
+
+	return nil
+}
+
+// Finalize returns the signed transaction, with unlocking scripts made from
+// the valid signatures collected. It fails with ErrIncompleteSignatures
+// while an input lacks signatures.
+func (pt *PartialTransaction) Finalize() (*Transaction, error) {
+	if err := pt.checkPrevTransactions(); err != nil {
+		return nil, err
+	}
+
+	tx := pt.Tx
+	tx.Inputs = append([]TxInput{}, pt.Tx.Inputs...)
+
+	for inId, input := range pt.Inputs {
+		subScript, err := pt.signScript(inId)
+		if err != nil {
+			return nil, err
+		}
+
+		unlocking, err := pt.unlockingScript(inId, subScript)
+		if err != nil {
+			return nil, err
+		}
+		if input.RedeemScript != nil {
+			unlocking = script.UnlockScriptHash(unlocking, input.RedeemScript)
+		}
+		tx.Inputs[inId].UnlockingScript = unlocking
+	}
+	tx.ID = tx.Hash()
+
+	prevOuts, err := prevOutputs(&tx, pt.prevTransactions())
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.verifyScripts(prevOuts); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// unlockingScript returns the script unlocking subScript for input in with
+// the collected signatures
+func (pt *PartialTransaction) unlockingScript(in int, subScript []byte) ([]byte, error) {
+	signatures := pt.Inputs[in].Signatures
+
+	if required, pubKeys, ok := script.ExtractMultiSig(subScript); ok {
+		var sigs [][]byte
+		for _, pubKey := range pubKeys {
+			sig := signatures[hex.EncodeToString(pubKey)]
+			if sig != nil && len(sigs) < required && pt.Tx.checkSignature(in, subScript, pubKey, sig) {
+				sigs = append(sigs, sig)
+			}
+		}
+		if len(sigs) < required {
+			return nil, fmt.Errorf("input %d has %d of %d signatures: %w", in, len(sigs), required, ErrIncompleteSignatures)
+		}
+		return script.UnlockMultiSig(sigs), nil
+	}
+
+	switch class := script.Classify(subScript); class {
+	case script.PubKeyHash, script.TimeLock, script.SequenceLock:
+	default:
+		return nil, fmt.Errorf("input %d spends a %s script, which can not be finalized", in, class)
+	}
+
+	for key, sig := range signatures {
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		if canSign(subScript, pubKey) && pt.Tx.checkSignature(in, subScript, pubKey, sig) {
+			return script.UnlockPubKeyHash(sig, pubKey), nil
+		}
+	}
+
+	return nil, fmt.Errorf("input %d is not signed: %w", in, ErrIncompleteSignatures)
+}
+
+// prevTransactions returns the previous transactions keyed by ID, as
+// Transaction.Verify takes them
+func (pt *PartialTransaction) prevTransactions() map[string]Transaction {
+	prevTXs := make(map[string]Transaction)
+
+	for i, in := range pt.Tx.Inputs {
+		prevTXs[hex.EncodeToString(in.ID)] = pt.Inputs[i].PrevTx
+	}
+
+	return prevTXs
+}
@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// newTestPSBT returns a partial transaction paying 20 from the genesis output
+// of chain, owned by w, with a fee of 1
+func newTestPSBT(t *testing.T, chain *Blockchain, w *wallet.Wallet) *PartialTransaction {
+	t.Helper()
+
+	from := string(w.Address(chain.Params.AddressVersion))
+	to := string(wallet.CreateWallet().Address(chain.Params.AddressVersion))
+	pt, err := CreatePartialTransaction(from, to, 20, Fee{Amount: 1}, PaymentLock{}, &UTXOSet{chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pt
+}
+
+func TestPartialTransactionSign(t *testing.T) {
+	chain, w, cleanup := newTestChain(t)
+	defer cleanup()
+	wallets := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{
+		string(w.Address(chain.Params.AddressVersion)): w,
+	}}
+
+	pt, err := DeserializePartialTransaction(newTestPSBT(t, chain, w).Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee := pt.Fee(); fee != 1 {
+		t.Errorf("fee = %d, want 1", fee)
+	}
+	if signed, err := pt.Sign(wallets, SigHashAll); err != nil || signed != 1 {
+		t.Fatalf("signed %d inputs, %v; want 1", signed, err)
+	}
+	tx, err := pt.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := chain.VerifyTransaction(tx); err != nil || !ok {
+		t.Errorf("finalized transaction does not verify: %v", err)
+	}
+}
+
+func TestPartialTransactionTampered(t *testing.T) {
+	chain, w, cleanup := newTestChain(t)
+	defer cleanup()
+	wallets := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{
+		string(w.Address(chain.Params.AddressVersion)): w,
+	}}
+
+	tests := []struct {
+		name   string
+		tamper func(pt *PartialTransaction)
+	}{
+		{"spent value raised to hide the fee", func(pt *PartialTransaction) {
+			pt.Inputs[0].PrevTx.Outputs[pt.Tx.Inputs[0].Out].Value += 1000
+		}},
+		{"other previous transaction", func(pt *PartialTransaction) {
+			pt.Inputs[0].PrevTx = pt.Tx
+		}},
+		{"huge output index", func(pt *PartialTransaction) {
+			pt.Tx.Inputs[0].Out = 1 << 40
+		}},
+		{"negative output index", func(pt *PartialTransaction) {
+			pt.Tx.Inputs[0].Out = -1
+		}},
+		{"input without its description", func(pt *PartialTransaction) {
+			pt.Inputs = nil
+		}},
+	}
+	for _, tt := range tests {
+		pt := newTestPSBT(t, chain, w)
+		tt.tamper(pt)
+
+		if _, err := DeserializePartialTransaction(pt.Serialize()); err == nil {
+			t.Errorf("%s: tampered partial transaction was decoded", tt.name)
+		}
+		if _, err := pt.Sign(wallets, SigHashAll); err == nil {
+			t.Errorf("%s: tampered partial transaction was signed", tt.name)
+		}
+	}
+}
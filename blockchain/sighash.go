@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// SigHashType selects the parts of a transaction a signature covers. It is
+// appended to every input signature. SigHashAll covers every input and
+// output, SigHashNone no output and SigHashSingle only the output at the
+// index of the signed input. SigHashAnyoneCanPay added to any of them leaves
+// out the other inputs, so more can be added later.
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01
+	SigHashNone         SigHashType = 0x02
+	SigHashSingle       SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+)
+
+var sigHashNames = map[SigHashType]string{
+	SigHashAll:    "ALL",
+	SigHashNone:   "NONE",
+	SigHashSingle: "SINGLE",
+}
+
+func (t SigHashType) base() SigHashType {
+	return t &^ SigHashAnyoneCanPay
+}
+
+// IsValid reports whether t is one of the defined hash types
+func (t SigHashType) IsValid() bool {
+	_, ok := sigHashNames[t.base()]
+
+	return ok && t&^(SigHashAnyoneCanPay|0x03) == 0
+}
+
+func (t SigHashType) String() string {
+	if !t.IsValid() {
+		return fmt.Sprintf("0x%02x", byte(t))
+	}
+
+	name := sigHashNames[t.base()]
+	if t&SigHashAnyoneCanPay != 0 {
+		name += "|ANYONECANPAY"
+	}
+
+	return name
+}
+
+// ParseSigHashType parses the form printed by SigHashType.String, such as
+// "ALL" or "SINGLE|ANYONECANPAY", ignoring case
+func ParseSigHashType(s string) (SigHashType, error) {
+	parts := strings.Split(strings.ToUpper(s), "|")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "ANYONECANPAY") {
+		return 0, fmt.Errorf("invalid signature hash type %q", s)
+	}
+
+	for t, name := range sigHashNames {
+		if parts[0] == name {
+			if len(parts) == 2 {
+				t |= SigHashAnyoneCanPay
+			}
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid signature hash type %q", s)
+}
+
+// TrimmedCopy returns the copy of tx that the signature of input in with
+// hashType covers. Every unlocking script is removed and the one of input in
+// replaced by subScript, the script being executed. SigHashNone and
+// SigHashSingle drop the outputs not signed and zero the sequences of the
+// other inputs, which may then change them. SigHashAnyoneCanPay keeps input
+// in alone.
+func (tx *Transaction) TrimmedCopy(in int, subScript []byte, hashType SigHashType) Transaction {
+	var inputs []TxInput
+	var outputs []TxOutput
+
+	for i, input := range tx.Inputs {
+		copied := TxInput{input.ID, input.Out, nil, input.Sequence}
+		if i == in {
+			copied.UnlockingScript = subScript
+		} else if hashType&SigHashAnyoneCanPay != 0 {
+			continue
+		} else if hashType.base() != SigHashAll {
+			copied.Sequence = 0
+		}
+		inputs = append(inputs, copied)
+	}
+
+	switch hashType.base() {
+	case SigHashAll:
+		for _, out := range tx.Outputs {
+			outputs = append(outputs, TxOutput{out.Value, out.LockingScript})
+		}
+	case SigHashSingle:
+		// The outputs before the signed one keep their place but not their
+		// contents
+		for i := 0; i < in; i++ {
+			outputs = append(outputs, TxOutput{-1, nil})
+		}
+		outputs = append(outputs, TxOutput{tx.Outputs[in].Value, tx.Outputs[in].LockingScript})
+	}
+
+	return Transaction{nil, inputs, outputs, tx.LockTime}
+}
+
+// SignatureHash returns the hash signed by the signatures of input in with
+// hashType, for an input whose locking or redeem script is subScript. It
+// covers TrimmedCopy followed by hashType.
+func (tx *Transaction) SignatureHash(in int, subScript []byte, hashType SigHashType) ([]byte, error) {
+	if in < 0 || in >= len(tx.Inputs) {
+		return nil, fmt.Errorf("input %d is out of range", in)
+	}
+	if !hashType.IsValid() {
+		return nil, fmt.Errorf("invalid signature hash type %s", hashType)
+	}
+	if hashType.base() == SigHashSingle && in >= len(tx.Outputs) {
+		return nil, fmt.Errorf("input %d has no output to sign with %s", in, hashType)
+	}
+
+	txCopy := tx.TrimmedCopy(in, subScript, hashType)
+	hash := sha256.Sum256(append(txCopy.Serialize(), byte(hashType)))
+
+	return hash[:], nil
+}
+
+// SignInput returns the signature of input in by privateKey with hashType,
+// for an input whose locking or redeem script is subScript
+func (tx *Transaction) SignInput(in int, subScript []byte, privateKey ecdsa.PrivateKey, hashType SigHashType) ([]byte, error) {
+	hash, err := tx.SignatureHash(in, subScript, hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := wallet.Sign(&privateKey, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(sig, byte(hashType)), nil
+}
+
+// checkSignature reports whether sig, made by SignInput, is a valid
+// signature of input in by pubKey for subScript
+func (tx *Transaction) checkSignature(in int, subScript, pubKey, sig []byte) bool {
+	if len(sig) == 0 {
+		return false
+	}
+
+	hash, err := tx.SignatureHash(in, subScript, SigHashType(sig[len(sig)-1]))
+	if err != nil {
+		return false
+	}
+
+	return wallet.Verify(pubKey, hash, sig[:len(sig)-1])
+}
@@ -0,0 +1,145 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// sighashTx returns a transaction of three inputs and two outputs, none of
+// them signed
+func sighashTx() *Transaction {
+	payee := script.PayToPubKeyHash(wallet.PublicKeyHash(wallet.CreateWallet().PublicKey))
+
+	return &Transaction{
+		Inputs: []TxInput{
+			{ID: []byte("first previous transaction"), Out: 0, Sequence: 1},
+			{ID: []byte("second previous transaction"), Out: 1, Sequence: 2},
+			{ID: []byte("third previous transaction"), Out: 2, Sequence: 3},
+		},
+		Outputs:  []TxOutput{{20, payee}, {30, payee}},
+		LockTime: 7,
+	}
+}
+
+func TestSignatureHashTypes(t *testing.T) {
+	signer := wallet.CreateWallet()
+	subScript := script.PayToPubKeyHash(wallet.PublicKeyHash(signer.PublicKey))
+	otherScript := script.PayToPubKeyHash(wallet.PublicKeyHash(wallet.CreateWallet().PublicKey))
+
+	var (
+		changeOutput  = func(tx *Transaction) { tx.Outputs[0].Value = 25 }
+		replaceOutput = func(tx *Transaction) { tx.Outputs[1].LockingScript = otherScript }
+		addOutput     = func(tx *Transaction) { tx.Outputs = append(tx.Outputs, TxOutput{5, otherScript}) }
+		dropOutputs   = func(tx *Transaction) { tx.Outputs = nil }
+		otherSequence = func(tx *Transaction) { tx.Inputs[0].Sequence = 9 }
+		otherInput    = func(tx *Transaction) { tx.Inputs[0].ID = []byte("another previous transaction") }
+		addInput      = func(tx *Transaction) { tx.Inputs = append(tx.Inputs, TxInput{ID: []byte("added"), Out: 0}) }
+		ownSequence   = func(tx *Transaction) { tx.Inputs[1].Sequence = 9 }
+		ownInput      = func(tx *Transaction) { tx.Inputs[1].Out = 5 }
+		lockTime      = func(tx *Transaction) { tx.LockTime = 8 }
+	)
+
+	// Every case signs input 1
+	tests := []struct {
+		name     string
+		hashType SigHashType
+		tamper   func(tx *Transaction)
+		valid    bool
+	}{
+		{"all, output changed", SigHashAll, changeOutput, false},
+		{"all, output added", SigHashAll, addOutput, false},
+		{"all, other sequence changed", SigHashAll, otherSequence, false},
+		{"all, other input changed", SigHashAll, otherInput, false},
+		{"all, lock time changed", SigHashAll, lockTime, false},
+
+		{"none, output changed", SigHashNone, changeOutput, true},
+		{"none, output replaced", SigHashNone, replaceOutput, true},
+		{"none, outputs dropped", SigHashNone, dropOutputs, true},
+		{"none, other sequence changed", SigHashNone, otherSequence, true},
+		{"none, other input changed", SigHashNone, otherInput, false},
+		{"none, input added", SigHashNone, addInput, false},
+		{"none, own sequence changed", SigHashNone, ownSequence, false},
+		{"none, lock time changed", SigHashNone, lockTime, false},
+
+		{"single, earlier output changed", SigHashSingle, changeOutput, true},
+		{"single, output added", SigHashSingle, addOutput, true},
+		{"single, other sequence changed", SigHashSingle, otherSequence, true},
+		{"single, own output replaced", SigHashSingle, replaceOutput, false},
+		{"single, outputs dropped", SigHashSingle, dropOutputs, false},
+		{"single, other input changed", SigHashSingle, otherInput, false},
+
+		{"all|anyonecanpay, other input changed", SigHashAll | SigHashAnyoneCanPay, otherInput, true},
+		{"all|anyonecanpay, other sequence changed", SigHashAll | SigHashAnyoneCanPay, otherSequence, true},
+		{"all|anyonecanpay, input added", SigHashAll | SigHashAnyoneCanPay, addInput, true},
+		{"all|anyonecanpay, output changed", SigHashAll | SigHashAnyoneCanPay, changeOutput, false},
+		{"all|anyonecanpay, own input changed", SigHashAll | SigHashAnyoneCanPay, ownInput, false},
+		{"all|anyonecanpay, own sequence changed", SigHashAll | SigHashAnyoneCanPay, ownSequence, false},
+
+		{"none|anyonecanpay, everything else changed", SigHashNone | SigHashAnyoneCanPay, func(tx *Transaction) {
+			otherInput(tx)
+			addInput(tx)
+			dropOutputs(tx)
+		}, true},
+		{"single|anyonecanpay, earlier output and other input changed", SigHashSingle | SigHashAnyoneCanPay, func(tx *Transaction) {
+			changeOutput(tx)
+			otherInput(tx)
+		}, true},
+		{"single|anyonecanpay, own output replaced", SigHashSingle | SigHashAnyoneCanPay, replaceOutput, false},
+	}
+	for _, tt := range tests {
+		tx := sighashTx()
+		sig, err := tx.SignInput(1, subScript, signer.PrivateKey, tt.hashType)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !tx.checkSignature(1, subScript, signer.PublicKey, sig) {
+			t.Fatalf("%s: untouched transaction does not verify", tt.name)
+		}
+
+		tt.tamper(tx)
+		if valid := tx.checkSignature(1, subScript, signer.PublicKey, sig); valid != tt.valid {
+			t.Errorf("%s: signature valid = %t, want %t", tt.name, valid, tt.valid)
+		}
+	}
+
+	// The hash type is covered, so it cannot be swapped for a weaker one
+	tx := sighashTx()
+	sig, err := tx.SignInput(1, subScript, signer.PrivateKey, SigHashAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[len(sig)-1] = byte(SigHashNone)
+	if tx.checkSignature(1, subScript, signer.PublicKey, sig) {
+		t.Error("signature verifies with its hash type changed")
+	}
+}
+
+func TestSignatureHashSingleOutOfRange(t *testing.T) {
+	signer := wallet.CreateWallet()
+	subScript := script.PayToPubKeyHash(wallet.PublicKeyHash(signer.PublicKey))
+
+	// Input 2 has no output of its own, so nothing can be signed with
+	// SigHashSingle rather than a fixed hash any signature would match
+	tx := sighashTx()
+	for _, hashType := range []SigHashType{SigHashSingle, SigHashSingle | SigHashAnyoneCanPay} {
+		if _, err := tx.SignatureHash(2, subScript, hashType); err == nil {
+			t.Errorf("%s: input past the outputs was hashed", hashType)
+		}
+		if _, err := tx.SignInput(2, subScript, signer.PrivateKey, hashType); err == nil {
+			t.Errorf("%s: input past the outputs was signed", hashType)
+		}
+	}
+
+	// A signature of input 2 made with SigHashAll does not pass as one made
+	// with SigHashSingle
+	sig, err := tx.SignInput(2, subScript, signer.PrivateKey, SigHashAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[len(sig)-1] = byte(SigHashSingle)
+	if tx.checkSignature(2, subScript, signer.PublicKey, sig) {
+		t.Error("signature of an input past the outputs verifies with SigHashSingle")
+	}
+}
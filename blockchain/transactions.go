@@ -3,27 +3,34 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
+	"sort"
 	"strings"
 
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/script"
 	"github.com/bahadylbekov/go-blockchain/wallet"
 )
 
+// LockTimeThreshold separates the two meanings of a lock time. Smaller values
+// are block heights, larger ones Unix timestamps.
+const LockTimeThreshold = 500000000
+
+// Transaction moves value from the outputs spent by its inputs to new
+// outputs. A non-zero LockTime keeps it out of blocks until that height or
+// time has passed.
 type Transaction struct {
-	ID      []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime int64
 }
 
-const MiningReward = 50
-
 func (tx *Transaction) Serialize() []byte {
 	var res bytes.Buffer
 	encoder := gob.NewEncoder(&res)
@@ -33,176 +40,473 @@ func (tx *Transaction) Serialize() []byte {
 	return res.Bytes()
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// DeserializeTransaction decodes a transaction encoded by Serialize
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	var tx Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&tx); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// CoinbaseTx creates the coinbase transaction of the block at height, paying
+// the block subsidy plus fees to the address to
+func CoinbaseTx(to, data string, height, fees int, params *chaincfg.ChainParams) (*Transaction, error) {
 	if data == "" {
 		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
-		HandleErr(err)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
 		data = fmt.Sprintf("%x", randData)
 
 	}
-	txInput := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txOutput := NewTxOutput(MiningReward, to)
+	txInput := TxInput{ID: []byte{}, Out: -1, UnlockingScript: []byte(data)}
+	txOutput, err := NewTxOutput(params.BlockSubsidy(height)+fees, to, params)
+	if err != nil {
+		return nil, err
+	}
 
-	tx := Transaction{nil, []TxInput{txInput}, []TxOutput{*txOutput}}
+	tx := Transaction{Inputs: []TxInput{txInput}, Outputs: []TxOutput{*txOutput}}
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
 
+// Hash returns the ID of the transaction. It leaves out the unlocking
+// scripts of the inputs, the witness holding the signatures, so re-encoding a
+// signature changes neither the ID nor the inputs of transactions spending
+// its outputs. The data of a coinbase input is no witness and is covered.
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
+	var inputs []TxInput
+
+	for _, in := range tx.Inputs {
+		stripped := TxInput{in.ID, in.Out, nil, in.Sequence}
+		if tx.IsCoinBase() {
+			stripped.UnlockingScript = in.UnlockingScript
+		}
+		inputs = append(inputs, stripped)
+	}
+
+	newTx := Transaction{nil, inputs, tx.Outputs, tx.LockTime}
+	hash := sha256.Sum256(newTx.Serialize())
+
+	return hash[:]
+}
 
+// WitnessHash returns the hash of the whole transaction, unlocking scripts
+// included. Blocks commit to it in their witness root.
+func (tx *Transaction) WitnessHash() []byte {
 	newTx := *tx
 	newTx.ID = []byte{}
 
-	hash = sha256.Sum256(newTx.Serialize())
+	hash := sha256.Sum256(newTx.Serialize())
 
 	return hash[:]
 }
 
+// OutputValue returns the sum of all output values
+func (tx *Transaction) OutputValue() int {
+	value := 0
+	for _, out := range tx.Outputs {
+		value += out.Value
+	}
+
+	return value
+}
+
 func (tx *Transaction) IsCoinBase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTx map[string]Transaction) {
+// IsFinal reports whether tx may be included in a block at height whose
+// median time past is blockTime
+func (tx *Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < LockTimeThreshold {
+		return tx.LockTime < int64(height)
+	}
+
+	return tx.LockTime < blockTime
+}
+
+// Sign signs every input of tx with privateKey and hashType. All inputs must
+// spend pay-to-pubkey-hash, time-lock or sequence-lock outputs of that key;
+// other scripts are signed with SignInput. The lock time and sequences of tx
+// must be set beforehand, as the signatures cover them.
+func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType SigHashType) error {
+	if tx.IsCoinBase() {
+		return nil
+	}
+	if err := checkPrevOutputs(tx, prevTXs); err != nil {
+		return err
+	}
+
+	pubKeyHash := wallet.PublicKeyHash(wallet.EncodePublicKey(&privateKey.PublicKey))
+	for inId, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+		if _, _, ok := keyLock(prevOut, pubKeyHash); !ok {
+			return fmt.Errorf("input %d does not spend an output of this key", inId)
+		}
+	}
+
+	_, err := tx.SignOwnInputs(privateKey, prevTXs, hashType)
+
+	return err
+}
+
+// SignOwnInputs signs the inputs of tx that spend pay-to-pubkey-hash,
+// time-lock or sequence-lock outputs of privateKey with hashType and leaves
+// the other inputs alone. It returns the number of inputs signed. Unlocking
+// scripts are not part of the ID, so the ID set is that of the unsigned tx.
+func (tx *Transaction) SignOwnInputs(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType SigHashType) (int, error) {
 	if tx.IsCoinBase() {
-		return
+		return 0, nil
+	}
+	if err := checkPrevOutputs(tx, prevTXs); err != nil {
+		return 0, err
 	}
 
+	pubKey := wallet.EncodePublicKey(&privateKey.PublicKey)
+	pubKeyHash := wallet.PublicKeyHash(pubKey)
+	signed := 0
+
+	for inId, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+		if _, _, ok := keyLock(prevOut, pubKeyHash); !ok {
+			continue
+		}
+
+		signature, err := tx.SignInput(inId, prevOut.LockingScript, privateKey, hashType)
+		if err != nil {
+			return signed, err
+		}
+		tx.Inputs[inId].UnlockingScript = script.UnlockPubKeyHash(signature, pubKey)
+		signed++
+	}
+	tx.ID = tx.Hash()
+
+	return signed, nil
+}
+
+// checkPrevOutputs checks that prevTXs holds the outputs spent by tx
+func checkPrevOutputs(tx *Transaction, prevTXs map[string]Transaction) error {
 	for _, in := range tx.Inputs {
-		if prevTx[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction doesn't exist")
+		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
+			return fmt.Errorf("%w: previous transaction %x", ErrTxNotFound, in.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prevTXs[hex.EncodeToString(in.ID)].Outputs) {
+			return fmt.Errorf("%w: output %d of %x", ErrTxNotFound, in.Out, in.ID)
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
+	return nil
+}
 
-	for inId, in := range txCopy.Inputs {
-		prevTx := prevTx[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+// Fee selects the fee paid by a new transaction. Rate, when set, is the fee
+// per 1000 bytes of the serialized transaction, rounded up, and takes
+// precedence over Amount.
+type Fee struct {
+	Amount int
+	Rate   int
+}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.ID)
-		HandleErr(err)
-		signature := append(r.Bytes(), s.Bytes()...)
-		txCopy.Inputs[inId].Signature = signature
+// ForSize returns the fee f.Rate asks for a transaction of size bytes
+func (f Fee) ForSize(size int) int {
+	return (f.Rate*size + 999) / 1000
+}
+
+// NewTransaction builds and signs a transaction paying amount to the address
+// to, under lock, from the confirmed outputs of w. Time-locked outputs of w
+// are spent once their lock has passed. Whatever the inputs hold beyond
+// amount and the fee returns to w as change.
+func NewTransaction(w *wallet.Wallet, to string, amount int, fee Fee, lock PaymentLock, u *UTXOSet) (*Transaction, error) {
+	return newTransaction(w, to, amount, fee, lock, u.Blockchain, u.findKeyOutputs)
+}
+
+func newTransaction(w *wallet.Wallet, to string, amount int, fee Fee, lock PaymentLock, chain *Blockchain, findSpendable func([]byte, int) (int, map[string][]int, error)) (*Transaction, error) {
+	if amount <= 0 || fee.Amount < 0 || fee.Rate < 0 {
+		return nil, fmt.Errorf("invalid amount %d or fee %d", amount, fee.Amount)
 	}
+
+	payment, err := lock.output(amount, to, chain.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	return fundTransaction(fee, func(fee int) (*Transaction, error) {
+		return buildTransaction(w, *payment, fee, chain, findSpendable)
+	})
 }
 
-func (tx *Transaction) TrimmedCopy() Transaction {
-	var inputs []TxInput
-	var outputs []TxOutput
+// NewDataTransaction builds and signs a transaction carrying data in a null
+// data output, paying only the fee from the confirmed outputs of w
+func NewDataTransaction(w *wallet.Wallet, data []byte, fee Fee, u *UTXOSet) (*Transaction, error) {
+	return newDataTransaction(w, data, fee, u.Blockchain, u.findKeyOutputs)
+}
 
-	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+func newDataTransaction(w *wallet.Wallet, data []byte, fee Fee, chain *Blockchain, findSpendable func([]byte, int) (int, map[string][]int, error)) (*Transaction, error) {
+	if fee.Amount < 0 || fee.Rate < 0 {
+		return nil, fmt.Errorf("invalid fee %d", fee.Amount)
 	}
 
-	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+	output, err := NewDataOutput(data)
+	if err != nil {
+		return nil, err
 	}
-	txCopy := Transaction{tx.ID, inputs, outputs}
 
-	return txCopy
+	return fundTransaction(fee, func(fee int) (*Transaction, error) {
+		return buildTransaction(w, *output, fee, chain, findSpendable)
+	})
 }
 
-func NewTransaction(from, to string, amount int, u *UTXOSet) *Transaction {
-	var inputs []TxInput
-	var outputs []TxOutput
+// fundTransaction returns the transaction build makes for the fee selected
+// by fee
+func fundTransaction(fee Fee, build func(fee int) (*Transaction, error)) (*Transaction, error) {
+	if fee.Rate == 0 {
+		return build(fee.Amount)
+	}
 
-	wallets, err := wallet.CreateWallets()
-	HandleErr(err)
-	w := wallets.GetWallet(from)
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	// The size depends on the number of inputs, which depends on the fee, so
+	// raise the fee until it covers the size of the resulting transaction
+	required := 0
+	for {
+		tx, err := build(required)
+		if err != nil {
+			return nil, err
+		}
+
+		need := fee.ForSize(len(tx.Serialize()))
+		if required >= need {
+			return tx, nil
+		}
+		required = need
+	}
+}
+
+// buildTransaction builds and signs a transaction making payment from the
+// outputs of w found by findSpendable
+func buildTransaction(w *wallet.Wallet, payment TxOutput, fee int, chain *Blockchain, findSpendable func([]byte, int) (int, map[string][]int, error)) (*Transaction, error) {
+	tx, prevTXs, err := assembleTransaction(wallet.PublicKeyHash(w.PublicKey), payment, fee, chain, findSpendable)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Sign(w.PrivateKey, prevTXs, SigHashAll); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// assembleTransaction returns an unsigned transaction making payment from the
+// outputs of pubKeyHash found by findSpendable, with its locks set, together
+// with the transactions it spends from
+func assembleTransaction(pubKeyHash []byte, payment TxOutput, fee int, chain *Blockchain, findSpendable func([]byte, int) (int, map[string][]int, error)) (*Transaction, map[string]Transaction, error) {
+	amount := payment.Value
+
+	// A transaction needs an input even if it pays nothing
+	need := amount + fee
+	if need == 0 {
+		need = 1
+	}
+
+	acc, validOutputs, err := findSpendable(pubKeyHash, need)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if acc < need {
+		return nil, nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, acc, need)
+	}
 
-	acc, validOutputs := u.FindSpendableOutputs(pubKeyHash, amount)
+	inputs, err := spendInputs(validOutputs)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if acc < amount {
-		log.Panic("Error: Account doesn't have enough funds")
+	outputs := []TxOutput{payment}
+	if acc > amount+fee {
+		outputs = append(outputs, TxOutput{acc - amount - fee, script.PayToPubKeyHash(pubKeyHash)})
 	}
 
-	for txid, outs := range validOutputs {
+	tx := Transaction{Inputs: inputs, Outputs: outputs}
+	prevTXs, err := chain.prevTransactions(&tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := applyKeyLocks(&tx, pubKeyHash, prevTXs); err != nil {
+		return nil, nil, err
+	}
+	tx.ID = tx.Hash()
+
+	return &tx, prevTXs, nil
+}
+
+// spendInputs returns unsigned inputs spending the outputs found by
+// FindSpendableOutputs, ordered by transaction ID
+func spendInputs(validOutputs map[string][]int) ([]TxInput, error) {
+	var inputs []TxInput
+
+	txids := make([]string, 0, len(validOutputs))
+	for txid := range validOutputs {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+
+	for _, txid := range txids {
 		txID, err := hex.DecodeString(txid)
-		HandleErr(err)
+		if err != nil {
+			return nil, err
+		}
 
-		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
-			inputs = append(inputs, input)
+		for _, out := range validOutputs[txid] {
+			inputs = append(inputs, TxInput{ID: txID, Out: out})
 		}
 	}
 
-	outputs = append(outputs, *NewTxOutput(amount, to))
+	return inputs, nil
+}
 
-	if acc > amount {
-		outputs = append(outputs, *NewTxOutput(acc-amount, from))
+// Verify checks the ID of tx and runs the scripts of every input against the
+// outputs they spend. A wrong ID or a failing script makes it return false, a
+// missing previous output an error.
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) (bool, error) {
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return false, nil
 	}
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	u.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	prevOuts, err := prevOutputs(tx, prevTXs)
+	if err != nil {
+		return false, err
+	}
 
-	return &tx
+	err = tx.verifyScripts(prevOuts)
+	if errors.Is(err, script.ErrScriptFailed) {
+		return false, nil
+	}
+
+	return err == nil, err
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+// prevOutputs returns the outputs spent by tx, taken from prevTXs and keyed
+// by outpoint
+func prevOutputs(tx *Transaction, prevTXs map[string]Transaction) (map[string]TxOutput, error) {
+	prevOuts := make(map[string]TxOutput)
 	if tx.IsCoinBase() {
-		return true
+		return prevOuts, nil
+	}
+	if err := checkPrevOutputs(tx, prevTXs); err != nil {
+		return nil, err
 	}
 
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous transaction doesn't exist")
-		}
+		prevOuts[outpoint(in.ID, in.Out)] = prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+	return prevOuts, nil
+}
+
+// verifyScripts runs the scripts of every input against the output it
+// spends, looked up in prevOuts by outpoint
+func (tx *Transaction) verifyScripts(prevOuts map[string]TxOutput) error {
+	if tx.IsCoinBase() {
+		return nil
+	}
 
 	for inId, in := range tx.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+		prevOut, ok := prevOuts[outpoint(in.ID, in.Out)]
+		if !ok {
+			return fmt.Errorf("%w: output %s", ErrTxNotFound, outpoint(in.ID, in.Out))
+		}
+		checker := txChecker{tx, inId}
+		if err := script.Verify(in.UnlockingScript, prevOut.LockingScript, checker); err != nil {
+			return fmt.Errorf("input %d: %w", inId, err)
+		}
+	}
+
+	return nil
+}
 
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[:(sigLen / 2)])
+// txChecker lets the scripts of input in check signatures and lock times
+// against tx
+type txChecker struct {
+	tx *Transaction
+	in int
+}
 
-		p := big.Int{}
-		q := big.Int{}
-		pubKeyLen := len(in.PubKey)
-		p.SetBytes(in.PubKey[:(pubKeyLen / 2)])
-		q.SetBytes(in.PubKey[:(pubKeyLen / 2)])
+func (c txChecker) CheckSig(sig, pubKey, subScript []byte) bool {
+	return c.tx.checkSignature(c.in, subScript, pubKey, sig)
+}
 
-		rawPubKey := ecdsa.PublicKey{curve, &p, &q}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
-			return false
+// CheckLockTime requires the transaction lock time to be of the same kind,
+// height or timestamp, as lockTime and at least as late
+func (c txChecker) CheckLockTime(lockTime int64) bool {
+	if (lockTime < LockTimeThreshold) != (c.tx.LockTime < LockTimeThreshold) {
+		return false
+	}
+
+	return lockTime <= c.tx.LockTime
+}
+
+// CheckSequence requires the input to carry an enabled relative lock of the
+// same kind, blocks or time, as sequence and at least as long. A sequence
+// with SequenceLockTimeDisabled set always passes.
+func (c txChecker) CheckSequence(sequence int64) bool {
+	if sequence&SequenceLockTimeDisabled != 0 {
+		return true
+	}
+
+	inSequence := int64(c.tx.Inputs[c.in].Sequence)
+	if inSequence&SequenceLockTimeDisabled != 0 {
+		return false
+	}
+	if sequence&SequenceLockTimeIsSeconds != inSequence&SequenceLockTimeIsSeconds {
+		return false
+	}
+
+	return sequence&SequenceLockTimeMask <= inSequence&SequenceLockTimeMask
+}
+
+// CarriesData reports whether a null data output of tx carries data
+func (tx *Transaction) CarriesData(data []byte) bool {
+	for _, out := range tx.Outputs {
+		if carried, ok := script.ExtractNullData(out.LockingScript); ok && bytes.Equal(carried, data) {
+			return true
 		}
 	}
-	return true
+
+	return false
 }
 
 func (tx Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %d", input.Sequence))
+		}
+		if tx.IsCoinBase() {
+			lines = append(lines, fmt.Sprintf("       Coinbase:  %x", input.UnlockingScript))
+		} else {
+			lines = append(lines, fmt.Sprintf("       Script:    %s", script.DisassembleString(input.UnlockingScript)))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", script.DisassembleString(output.LockingScript)))
 	}
 
 	return strings.Join(lines, "\n")
@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// signedPayment returns a transaction in which signer spends a 50 output,
+// paying 20 to another key, and the transactions it spends
+func signedPayment(t *testing.T, signer *wallet.Wallet) (*Transaction, map[string]Transaction) {
+	t.Helper()
+
+	prev := Transaction{Outputs: []TxOutput{{50, script.PayToPubKeyHash(wallet.PublicKeyHash(signer.PublicKey))}}}
+	prev.ID = prev.Hash()
+	prevTXs := map[string]Transaction{hex.EncodeToString(prev.ID): prev}
+
+	payee := wallet.CreateWallet()
+	tx := &Transaction{
+		Inputs: []TxInput{{ID: prev.ID, Out: 0}},
+		Outputs: []TxOutput{
+			{20, script.PayToPubKeyHash(wallet.PublicKeyHash(payee.PublicKey))},
+			{30, script.PayToPubKeyHash(wallet.PublicKeyHash(signer.PublicKey))},
+		},
+	}
+	tx.ID = tx.Hash()
+	if err := tx.Sign(signer.PrivateKey, prevTXs, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx, prevTXs
+}
+
+// withSignature replaces the signature in the unlocking script of the first
+// input of tx by the result of edit, keeping the public key
+func withSignature(t *testing.T, tx *Transaction, edit func(sig []byte) []byte) {
+	t.Helper()
+
+	pushes, err := script.PushedData(tx.Inputs[0].UnlockingScript)
+	if err != nil || len(pushes) != 2 {
+		t.Fatalf("unlocking script %x: %v", tx.Inputs[0].UnlockingScript, err)
+	}
+	sig := append([]byte{}, pushes[0]...)
+	tx.Inputs[0].UnlockingScript = script.UnlockPubKeyHash(edit(sig), pushes[1])
+}
+
+func TestTransactionSignVerify(t *testing.T) {
+	signer, other := wallet.CreateWallet(), wallet.CreateWallet()
+
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, tx *Transaction, prevTXs map[string]Transaction)
+		want   bool
+	}{
+		{"valid", func(*testing.T, *Transaction, map[string]Transaction) {}, true},
+		{"output value changed", func(t *testing.T, tx *Transaction, _ map[string]Transaction) {
+			tx.Outputs[0].Value = 29
+			tx.Outputs[1].Value = 21
+			tx.ID = tx.Hash()
+		}, false},
+		{"output value changed keeping the ID", func(t *testing.T, tx *Transaction, _ map[string]Transaction) {
+			tx.Outputs[0].Value = 29
+		}, false},
+		{"signature byte flipped", func(t *testing.T, tx *Transaction, _ map[string]Transaction) {
+			withSignature(t, tx, func(sig []byte) []byte {
+				sig[10] ^= 0xff
+				return sig
+			})
+		}, false},
+		{"high s", func(t *testing.T, tx *Transaction, _ map[string]Transaction) {
+			withSignature(t, tx, func(sig []byte) []byte {
+				n := elliptic.P256().Params().N
+				s := new(big.Int).SetBytes(sig[32:64])
+				b := s.Sub(n, s).Bytes()
+				for i := 32; i < 64; i++ {
+					sig[i] = 0
+				}
+				copy(sig[64-len(b):], b)
+				return sig
+			})
+		}, false},
+		{"signed by the wrong key", func(t *testing.T, tx *Transaction, prevTXs map[string]Transaction) {
+			prevOut := prevTXs[hex.EncodeToString(tx.Inputs[0].ID)].Outputs[0]
+			sig, err := tx.SignInput(0, prevOut.LockingScript, other.PrivateKey, SigHashAll)
+			if err != nil {
+				t.Fatal(err)
+			}
+			withSignature(t, tx, func([]byte) []byte { return sig })
+		}, false},
+		{"unlocked with the wrong key", func(t *testing.T, tx *Transaction, prevTXs map[string]Transaction) {
+			prevOut := prevTXs[hex.EncodeToString(tx.Inputs[0].ID)].Outputs[0]
+			sig, err := tx.SignInput(0, prevOut.LockingScript, other.PrivateKey, SigHashAll)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx.Inputs[0].UnlockingScript = script.UnlockPubKeyHash(sig, other.PublicKey)
+		}, false},
+	}
+	for _, tt := range tests {
+		tx, prevTXs := signedPayment(t, signer)
+		tt.tamper(t, tx, prevTXs)
+
+		ok, err := tx.Verify(prevTXs)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if ok != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestSignTransactionDeterministic(t *testing.T) {
+	signer := wallet.CreateWallet()
+	tx, prevTXs := signedPayment(t, signer)
+
+	again, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range again.Inputs {
+		again.Inputs[i].UnlockingScript = nil
+	}
+	if err := again.Sign(signer.PrivateKey, prevTXs, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again.Serialize(), tx.Serialize()) {
+		t.Errorf("signing twice gave %x and %x", tx.Serialize(), again.Serialize())
+	}
+	if !bytes.Equal(again.ID, tx.ID) {
+		t.Errorf("signing twice gave IDs %x and %x", tx.ID, again.ID)
+	}
+}
+
+// reencodePushes returns unlocking with every push made by OP_PUSHDATA1, an
+// encoding as valid as the minimal one
+func reencodePushes(t *testing.T, unlocking []byte) []byte {
+	t.Helper()
+
+	pushes, err := script.PushedData(unlocking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reencoded []byte
+	for _, data := range pushes {
+		reencoded = append(append(reencoded, script.OP_PUSHDATA1, byte(len(data))), data...)
+	}
+
+	return reencoded
+}
+
+func TestWitnessHash(t *testing.T) {
+	signer := wallet.CreateWallet()
+
+	tests := []struct {
+		name    string
+		replace func(t *testing.T, tx *Transaction, prevTXs map[string]Transaction)
+	}{
+		{"pushes re-encoded", func(t *testing.T, tx *Transaction, _ map[string]Transaction) {
+			tx.Inputs[0].UnlockingScript = reencodePushes(t, tx.Inputs[0].UnlockingScript)
+		}},
+		{"signed again with another hash type", func(t *testing.T, tx *Transaction, prevTXs map[string]Transaction) {
+			tx.Inputs[0].UnlockingScript = nil
+			if err := tx.Sign(signer.PrivateKey, prevTXs, SigHashAll|SigHashAnyoneCanPay); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		tx, prevTXs := signedPayment(t, signer)
+		id, witnessHash := tx.ID, tx.WitnessHash()
+		tt.replace(t, tx, prevTXs)
+
+		if !bytes.Equal(tx.Hash(), id) {
+			t.Errorf("%s: ID changed from %x to %x", tt.name, id, tx.Hash())
+		}
+		if bytes.Equal(tx.WitnessHash(), witnessHash) {
+			t.Errorf("%s: witness hash did not change", tt.name)
+		}
+		if ok, err := tx.Verify(prevTXs); err != nil || !ok {
+			t.Errorf("%s: replaced witness does not verify: %v", tt.name, err)
+		}
+	}
+}
@@ -2,63 +2,106 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
+	"fmt"
 
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/script"
 	"github.com/bahadylbekov/go-blockchain/wallet"
 )
 
+// TxOutput is a value locked by a script. Spending it requires an input
+// whose unlocking script makes the locking script succeed.
 type TxOutput struct {
-	Value      int
-	PubKeyHash []byte
-}
-
-type TxOutputs struct {
-	Outputs []TxOutput
+	Value         int
+	LockingScript []byte
 }
 
+// TxInput spends output Out of the transaction with hash ID. For coinbase
+// inputs UnlockingScript holds arbitrary data instead. Sequence holds a
+// relative lock, see SequenceLockTimeDisabled.
 type TxInput struct {
-	ID        []byte
-	Out       int
-	Signature []byte
-	PubKey    []byte
+	ID              []byte
+	Out             int
+	UnlockingScript []byte
+	Sequence        uint32
 }
 
-func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
+// PayToAddress returns the locking script paying to address: pay-to-script-hash
+// for script addresses of params, pay-to-pubkey-hash for key addresses. Any
+// other address is rejected with ErrInvalidAddress.
+func PayToAddress(address string, params *chaincfg.ChainParams) ([]byte, error) {
+	switch {
+	case wallet.ValidateAddress(address, params.ScriptAddressVersion):
+		return script.PayToScriptHash(wallet.AddressHash(address)), nil
+	case wallet.ValidateAddress(address, params.AddressVersion):
+		return script.PayToPubKeyHash(wallet.AddressHash(address)), nil
+	}
 
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, address)
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+// Lock makes the output payable to address
+func (out *TxOutput) Lock(address []byte, params *chaincfg.ChainParams) error {
+	lockingScript, err := PayToAddress(string(address), params)
+	if err != nil {
+		return err
+	}
+	out.LockingScript = lockingScript
 
-	out.PubKeyHash = pubKeyHash
+	return nil
 }
 
+// IsLockByKey reports whether the output is a pay-to-pubkey-hash output to pubKeyHash
 func (out *TxOutput) IsLockByKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	hash := script.ExtractPubKeyHash(out.LockingScript)
+
+	return hash != nil && bytes.Equal(hash, pubKeyHash)
 }
 
-func NewTxOutput(value int, address string) *TxOutput {
+func NewTxOutput(value int, address string, params *chaincfg.ChainParams) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock([]byte(address), params); err != nil {
+		return nil, err
+	}
+
+	return txo, nil
+}
 
-	return txo
+// NewDataOutput returns an output carrying data that can never be spent. It
+// is left out of the UTXO set.
+func NewDataOutput(data []byte) (*TxOutput, error) {
+	lockingScript, err := script.NullDataScript(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxOutput{0, lockingScript}, nil
 }
 
-func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	HandleErr(err)
-	return buffer.Bytes()
+// IsUnspendable reports whether no input can ever spend the output
+func (out *TxOutput) IsUnspendable() bool {
+	return script.IsUnspendable(out.LockingScript)
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
-	var txOutputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&txOutputs)
-	HandleErr(err)
-	return txOutputs
+// IsValidData reports whether the output, if it starts with OP_RETURN, is a
+// null data script within the data size limit
+func (out *TxOutput) IsValidData() bool {
+	if !out.IsUnspendable() {
+		return true
+	}
+	_, ok := script.ExtractNullData(out.LockingScript)
+
+	return ok
+}
+
+// NewMultiSigOutput returns an output locked by a bare multisig script, spent
+// with signatures of required of pubKeys. Paying to the script address of the
+// same keys keeps the keys out of the output until it is spent.
+func NewMultiSigOutput(value, required int, pubKeys [][]byte) (*TxOutput, error) {
+	lockingScript, err := script.MultiSigScript(required, pubKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxOutput{value, lockingScript}, nil
 }
@@ -0,0 +1,84 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+)
+
+func TestDataOutput(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+	u := UTXOSet{chain}
+
+	out, err := NewDataOutput(bytes.Repeat([]byte{1}, script.MaxDataCarrierSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != 0 || !out.IsUnspendable() || !out.IsValidData() {
+		t.Errorf("data output = %+v, want a valid unspendable output of no value", out)
+	}
+	if _, err := NewDataOutput(make([]byte, script.MaxDataCarrierSize+1)); err == nil {
+		t.Error("data output over the size limit was built")
+	}
+
+	// A confirmed data output stays out of the UTXO set, the change does not
+	data := []byte("notarized document hash")
+	tx, err := NewDataTransaction(alice, data, Fee{Amount: 1}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tx.CarriesData(data) {
+		t.Fatalf("transaction %x does not carry the data", tx.ID)
+	}
+	before, err := u.CountUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain, alice, tx)
+
+	for i, out := range tx.Outputs {
+		_, err := u.GetUTXO(tx.ID, i)
+		if out.IsUnspendable() && !errors.Is(err, ErrTxNotFound) {
+			t.Errorf("data output %d is in the UTXO set: %v", i, err)
+		} else if !out.IsUnspendable() && err != nil {
+			t.Errorf("output %d is not in the UTXO set: %v", i, err)
+		}
+	}
+	// The genesis output was replaced by the change, and the coinbase added
+	if after, err := u.CountUTXO(); err != nil || after != before+1 {
+		t.Errorf("UTXO set has %d outputs, %v; want %d", after, err, before+1)
+	}
+
+	// Oversize data is refused by the pool and in blocks
+	oversize, err := NewDataTransaction(alice, data, Fee{Amount: 1}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, out := range oversize.Outputs {
+		if out.IsUnspendable() {
+			oversize.Outputs[i].LockingScript = script.NewBuilder().AddOp(script.OP_RETURN).
+				AddData(make([]byte, script.MaxDataCarrierSize+1)).Script()
+		}
+	}
+	oversize.ID = oversize.Hash()
+
+	if err := NewMempool(chain, DefaultMaxMempoolSize).AddTransaction(oversize); !errors.Is(err, ErrTxRejected) {
+		t.Errorf("oversize data in the pool: got %v, want %v", err, ErrTxRejected)
+	}
+	tip, err := chain.GetBlockByHash(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := CoinbaseTx(addressOn(chain, alice), "", tip.Height+1, 1, chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chain.ValidateBlock(solveBlock(t, chain, tip, coinbase, oversize))
+	if !errors.Is(err, ErrInvalidBlock) || !strings.Contains(err.Error(), "data output over") {
+		t.Errorf("oversize data in a block: got %v, want an invalid block", err)
+	}
+}
@@ -0,0 +1,180 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+var (
+	txIndexKey    = []byte("txindex")
+	txIndexPrefix = []byte("tx-")
+)
+
+// TxLocation says where a confirmed transaction is stored
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func (loc TxLocation) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(loc)
+	HandleErr(err)
+
+	return res.Bytes()
+}
+
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	var loc TxLocation
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&loc)
+
+	return loc, err
+}
+
+func txIndexEntryKey(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+func hasTxIndex(txn *badger.Txn) (bool, error) {
+	_, err := txn.Get(txIndexKey)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// HasTxIndex reports whether the transaction index is built and maintained
+func (chain *Blockchain) HasTxIndex() (bool, error) {
+	var enabled bool
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		enabled, err = hasTxIndex(txn)
+		return err
+	})
+
+	return enabled, err
+}
+
+// indexTransactions records the location of every transaction in block, if
+// the index is enabled
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	if enabled, err := hasTxIndex(txn); err != nil || !enabled {
+		return err
+	}
+
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Hash, i}
+		if err := txn.Set(txIndexEntryKey(tx.ID), loc.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransactions removes the transactions of a disconnected block
+func unindexTransactions(txn *badger.Txn, block *Block) error {
+	if enabled, err := hasTxIndex(txn); err != nil || !enabled {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(txIndexEntryKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReindexTransactions drops the transaction index, rebuilds it from the main
+// chain and keeps it enabled from then on. It returns the number of indexed
+// transactions.
+func (chain *Blockchain) ReindexTransactions() (int, error) {
+	if err := deleteByPrefix(chain.Database, txIndexPrefix); err != nil {
+		return 0, err
+	}
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(txIndexKey, []byte{1})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return count, err
+		}
+
+		err = chain.Database.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(block.Transactions)
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return count, nil
+}
+
+// LocateTransaction looks a transaction up in the index. It returns
+// ErrTxNotFound when the index is enabled but has no such transaction.
+func (chain *Blockchain) LocateTransaction(ID []byte) (TxLocation, error) {
+	var loc TxLocation
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		loc, err = locateTransaction(txn, ID)
+		return err
+	})
+
+	return loc, err
+}
+
+func locateTransaction(txn *badger.Txn, ID []byte) (TxLocation, error) {
+	item, err := txn.Get(txIndexEntryKey(ID))
+	if err == badger.ErrKeyNotFound {
+		return TxLocation{}, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	} else if err != nil {
+		return TxLocation{}, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return TxLocation{}, err
+	}
+
+	return DeserializeTxLocation(v)
+}
+
+// findIndexedTransaction is the index backed path of FindTransaction. It
+// returns the block holding the transaction as well.
+func findIndexedTransaction(txn *badger.Txn, ID []byte) (*Transaction, *Block, error) {
+	loc, err := locateTransaction(txn, ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := getBlock(txn, loc.BlockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if loc.Position >= len(block.Transactions) || !bytes.Equal(block.Transactions[loc.Position].ID, ID) {
+		return nil, nil, fmt.Errorf("transaction index entry for %x is stale, run reindextx", ID)
+	}
+
+	return block.Transactions[loc.Position], block, nil
+}
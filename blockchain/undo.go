@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+var undoPrefix = []byte("undo-")
+
+// SpentOutput is an output spent by a block, with its UTXO entry
+type SpentOutput struct {
+	TxID  []byte
+	Out   int
+	Entry UTXOEntry
+}
+
+// BlockUndo holds what a block removed from the UTXO set, so the block can be
+// disconnected again without rebuilding the whole set
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo *BlockUndo) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(undo)
+	HandleErr(err)
+
+	return res.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) (*BlockUndo, error) {
+	var undo BlockUndo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo); err != nil {
+		return nil, err
+	}
+
+	return &undo, nil
+}
+
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+func getBlockUndo(txn *badger.Txn, hash []byte) (*BlockUndo, error) {
+	item, err := txn.Get(undoKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return nil, fmt.Errorf("no undo data for block %x, run reindexutxo", hash)
+	} else if err != nil {
+		return nil, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return DeserializeBlockUndo(v)
+}
@@ -2,9 +2,12 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
-	"log"
+	"fmt"
 
+	"github.com/bahadylbekov/go-blockchain/wallet"
 	"github.com/dgraph-io/badger"
 )
 
@@ -17,23 +20,94 @@ type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
+// UTXOEntry is one unspent output together with where it was created
+type UTXOEntry struct {
+	Output   TxOutput
+	Height   int
+	Coinbase bool
+}
+
+func (entry UTXOEntry) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(entry)
+	HandleErr(err)
+
+	return res.Bytes()
+}
+
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error) {
+	var entry UTXOEntry
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry)
+
+	return entry, err
+}
+
+// utxoKey is the key of the UTXO entry for output out of transaction txID.
+// The ID leaves out the unlocking scripts, so the key of an output does not
+// depend on how the signatures of its transaction were encoded.
+func utxoKey(txID []byte, out int) []byte {
+	key := make([]byte, prefixLength+len(txID)+4)
+	copy(key, utxoPrefix)
+	copy(key[prefixLength:], txID)
+	binary.BigEndian.PutUint32(key[prefixLength+len(txID):], uint32(out))
+
+	return key
+}
+
+// parseUTXOKey splits a UTXO key into transaction ID and output index
+func parseUTXOKey(key []byte) ([]byte, int) {
+	key = bytes.TrimPrefix(key, utxoPrefix)
+	split := len(key) - 4
+
+	return key[:split], int(binary.BigEndian.Uint32(key[split:]))
+}
+
+func getUTXO(txn *badger.Txn, txID []byte, out int) (UTXOEntry, error) {
+	item, err := txn.Get(utxoKey(txID, out))
+	if err == badger.ErrKeyNotFound {
+		return UTXOEntry{}, fmt.Errorf("%w: output %s is not in the UTXO set", ErrTxNotFound, outpoint(txID, out))
+	} else if err != nil {
+		return UTXOEntry{}, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return UTXOEntry{}, err
+	}
+
+	return DeserializeUTXOEntry(v)
+}
+
+// GetUTXO returns the unspent output out of transaction txID
+func (u UTXOSet) GetUTXO(txID []byte, out int) (UTXOEntry, error) {
+	var entry UTXOEntry
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		entry, err = getUTXO(txn, txID, out)
+		return err
+	})
+
+	return entry, err
+}
+
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	return deleteByPrefix(u.Blockchain.Database, prefix)
+}
+
+func deleteByPrefix(db *badger.DB, prefix []byte) error {
 	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return db.Update(func(txn *badger.Txn) error {
 			for _, key := range keysForDelete {
 				if err := txn.Delete(key); err != nil {
 					return err
 				}
 			}
 			return nil
-		}); err != nil {
-			return err
-		}
-		return nil
+		})
 	}
 
 	collectSize := 100000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
+	return db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
@@ -48,97 +122,151 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 
 			if keysCollected == collectSize {
 				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
+					return err
 				}
 				keysForDelete = make([][]byte, 0, collectSize)
 				keysCollected = 0
 			}
+		}
 
-			if keysCollected > 0 {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
+		if keysCollected > 0 {
+			if err := deleteKeys(keysForDelete); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
 }
 
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.Database
-	u.DeleteByPrefix(utxoPrefix)
-	UTXO := u.Blockchain.FindUnspentTransactions()
+// Reindex rebuilds the UTXO set and the undo records by replaying the main
+// chain from the genesis block
+func (u UTXOSet) Reindex() error {
+	chain := u.Blockchain
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+	if err := u.DeleteByPrefix(undoPrefix); err != nil {
+		return err
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	hashes, err := chain.GetBlockHashes(0, height)
+	if err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
+	for _, hash := range hashes {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			block, err := getBlock(txn, hash)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outs.Serialize())
-			HandleErr(err)
+
+			return updateUTXO(txn, block)
+		})
+		if err != nil {
+			return err
 		}
-		return nil
+	}
+
+	return nil
+}
+
+func (u *UTXOSet) Update(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return updateUTXO(txn, block)
 	})
-	HandleErr(err)
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+// updateUTXO applies block to the UTXO set and stores its undo record in the
+// same database transaction
+func updateUTXO(txn *badger.Txn, block *Block) error {
+	undo := BlockUndo{}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinBase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					HandleErr(err)
-					v, err := item.Value()
-					HandleErr(err)
-
-					outs := DeserializeOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
-					}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinBase() == false {
+			for _, in := range tx.Inputs {
+				entry, err := getUTXO(txn, in.ID, in.Out)
+				if err != nil {
+					return err
+				}
+				undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, entry})
 
+				if err := txn.Delete(utxoKey(in.ID, in.Out)); err != nil {
+					return err
 				}
 			}
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
+		}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+		for outIdx, out := range tx.Outputs {
+			if out.IsUnspendable() {
+				continue
+			}
+			entry := UTXOEntry{out, block.Height, tx.IsCoinBase()}
+			if err := txn.Set(utxoKey(tx.ID, outIdx), entry.Serialize()); err != nil {
+				return err
 			}
 		}
-		return nil
+	}
+
+	return txn.Set(undoKey(block.Hash), undo.Serialize())
+}
+
+// Rollback reverts Update for block using its undo record, restoring every
+// output the block spent exactly as it was
+func (u *UTXOSet) Rollback(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return rollbackUTXO(txn, block)
 	})
-	HandleErr(err)
 }
 
-func (u UTXOSet) CountUTXO() int {
+// rollbackUTXO disconnects block from the UTXO set. Transactions are undone
+// last first: the outputs of each are removed before the entries it spent are
+// restored, so an output created and spent within the block stays removed.
+func rollbackUTXO(txn *badger.Txn, block *Block) error {
+	undo, err := getBlockUndo(txn, block.Hash)
+	if err != nil {
+		return err
+	}
+
+	spent := undo.Spent
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		for outIdx := range tx.Outputs {
+			if err := txn.Delete(utxoKey(tx.ID, outIdx)); err != nil {
+				return err
+			}
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+
+		if len(spent) < len(tx.Inputs) {
+			return fmt.Errorf("undo record of block %x does not match its transactions", block.Hash)
+		}
+		restored := spent[len(spent)-len(tx.Inputs):]
+		spent = spent[:len(spent)-len(tx.Inputs)]
+		for _, entry := range restored {
+			if err := txn.Set(utxoKey(entry.TxID, entry.Out), entry.Entry.Serialize()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return txn.Delete(undoKey(block.Hash))
+}
+
+// CountUTXO returns the number of unspent outputs
+func (u UTXOSet) CountUTXO() (int, error) {
 	db := u.Blockchain.Database
 	counter := 0
 
 	err := db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
 
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -147,12 +275,12 @@ func (u UTXOSet) CountUTXO() int {
 		}
 		return nil
 	})
-	HandleErr(err)
 
-	return counter
+	return counter, err
 }
 
-func (u *UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
+// FindUTXO returns the unspent outputs locked by lockingScript
+func (u *UTXOSet) FindUTXO(lockingScript []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 
 	db := u.Blockchain.Database
@@ -165,22 +293,105 @@ func (u *UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 			item := it.Item()
 			v, err := item.Value()
-			HandleErr(err)
-			outs := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
+			}
 
-			for _, out := range outs.Outputs {
-				if out.IsLockByKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+			if bytes.Equal(entry.Output.LockingScript, lockingScript) {
+				UTXOs = append(UTXOs, entry.Output)
 			}
 		}
 		return nil
 	})
-	HandleErr(err)
-	return UTXOs
+
+	return UTXOs, err
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// Balance returns the value of the unspent outputs paid to address, split
+// into what a transaction in the next block can spend and what is still
+// time-locked. Outputs of script addresses always count as spendable.
+func (u UTXOSet) Balance(address string) (spendable, locked int, err error) {
+	if !wallet.ValidateAddress(address, u.Blockchain.Params.AddressVersion) {
+		lockingScript, err := PayToAddress(address, u.Blockchain.Params)
+		if err != nil {
+			return 0, 0, err
+		}
+		outputs, err := u.FindUTXO(lockingScript)
+		for _, out := range outputs {
+			spendable += out.Value
+		}
+		return spendable, 0, err
+	}
+
+	pubKeyHash := wallet.AddressHash(address)
+
+	err = u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		locks, err := newLockState(txn, u.Blockchain.LastHash)
+		if err != nil {
+			return err
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
+			}
+
+			lockTime, sequence, ok := keyLock(entry.Output, pubKeyHash)
+			if !ok {
+				continue
+			}
+			reached, err := locks.spendable(txn, lockTime, sequence, entry.Height)
+			if err != nil {
+				return err
+			}
+			if reached {
+				spendable += entry.Output.Value
+			} else {
+				locked += entry.Output.Value
+			}
+		}
+		return nil
+	})
+
+	return spendable, locked, err
+}
+
+// FindSpendableOutputs collects unspent outputs locked by lockingScript until
+// they are worth at least amount, and returns their value and outpoints
+func (u UTXOSet) FindSpendableOutputs(lockingScript []byte, amount int) (int, map[string][]int, error) {
+	return u.findSpendableOutputs(lockedBy(lockingScript), amount, nil)
+}
+
+// findKeyOutputs collects the unspent outputs the key of pubKeyHash can spend
+// in the next block, including time-locked outputs whose lock has passed
+func (u UTXOSet) findKeyOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	selector := &keySelector{pubKeyHash: pubKeyHash, tipHash: u.Blockchain.LastHash}
+
+	return u.findSpendableOutputs(selector.pickEntry, amount, nil)
+}
+
+// lockedBy returns a filter for findSpendableOutputs accepting the outputs
+// locked by lockingScript
+func lockedBy(lockingScript []byte) func(*badger.Txn, UTXOEntry) (bool, error) {
+	return func(_ *badger.Txn, entry UTXOEntry) (bool, error) {
+		return bytes.Equal(entry.Output.LockingScript, lockingScript), nil
+	}
+}
+
+// findSpendableOutputs collects the unspent outputs accepted by pick until
+// they are worth amount, ignoring the outputs for which skip returns true
+func (u UTXOSet) findSpendableOutputs(pick func(*badger.Txn, UTXOEntry) (bool, error), amount int, skip func(txID []byte, out int) bool) (int, map[string][]int, error) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.Database
@@ -190,24 +401,32 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix) && accumulated < amount; it.Next() {
 			item := it.Item()
-			k := item.Key()
 			v, err := item.Value()
-			HandleErr(err)
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockByKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
+			if err != nil {
+				return err
+			}
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
+			}
+			txID, outIdx := parseUTXOKey(item.Key())
+			if skip != nil && skip(txID, outIdx) {
+				continue
+			}
+			picked, err := pick(txn, entry)
+			if err != nil {
+				return err
+			}
+			if picked {
+				key := hex.EncodeToString(txID)
+				accumulated += entry.Output.Value
+				unspentOuts[key] = append(unspentOuts[key], outIdx)
 			}
 		}
 		return nil
 	})
-	HandleErr(err)
 
-	return accumulated, unspentOuts
+	return accumulated, unspentOuts, err
 }
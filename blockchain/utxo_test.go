@@ -0,0 +1,221 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// newTestChain creates a regtest chain in a temporary directory whose genesis
+// block pays w. The returned function closes and removes it.
+func newTestChain(t *testing.T) (*Blockchain, *wallet.Wallet, func()) {
+	return newTestChainParams(t, chaincfg.RegTestParams)
+}
+
+// newTestChainParams is newTestChain for a chain of params, whose DataDir is
+// replaced by the temporary directory
+func newTestChainParams(t *testing.T, params chaincfg.ChainParams) (*Blockchain, *wallet.Wallet, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.DataDir = dir
+
+	w := wallet.CreateWallet()
+	chain, err := InitBlockchain(string(w.Address(params.AddressVersion)), &params)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return chain, w, func() {
+		chain.Database.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// mineTransactions queues txs and mines them into a block paying its reward
+// to miner
+func mineTransactions(t *testing.T, chain *Blockchain, miner *wallet.Wallet, txs ...*Transaction) *Block {
+	t.Helper()
+
+	pool := NewMempool(chain, DefaultMaxMempoolSize)
+	for _, tx := range txs {
+		if err := pool.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block, err := pool.MineBlock(context.Background(), string(miner.Address(chain.Params.AddressVersion)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != len(txs)+1 {
+		t.Fatalf("block has %d transactions, want %d", len(block.Transactions), len(txs)+1)
+	}
+
+	return block
+}
+
+func TestSpendOutputsAcrossBlocks(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+	bob, carol := wallet.CreateWallet(), wallet.CreateWallet()
+	u := UTXOSet{chain}
+	address := func(w *wallet.Wallet) string { return string(w.Address(chain.Params.AddressVersion)) }
+
+	// Block 1: alice pays bob 20, keeping 30 as change in output 1
+	pay, err := NewTransaction(alice, address(bob), 20, Fee{}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain, alice, pay)
+
+	for out, want := range []int{20, 30} {
+		entry, err := u.GetUTXO(pay.ID, out)
+		if err != nil {
+			t.Fatalf("output %d: %v", out, err)
+		}
+		if entry.Output.Value != want || entry.Height != 1 || entry.Coinbase {
+			t.Errorf("output %d = %+v, want value %d at height 1", out, entry, want)
+		}
+	}
+
+	// Block 2: bob spends output 0
+	spendBob, err := NewTransaction(bob, address(carol), 5, Fee{}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransactions(t, chain, bob, spendBob)
+
+	if _, err := u.GetUTXO(pay.ID, 0); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("spent output 0 is still unspent: %v", err)
+	}
+	if entry, err := u.GetUTXO(pay.ID, 1); err != nil || entry.Height != 1 {
+		t.Errorf("output 1 = %+v, %v; want it unspent from height 1", entry, err)
+	}
+
+	// The spendable outputs of alice name the change by its own index
+	_, spendable, err := u.FindSpendableOutputs(pay.Outputs[1].LockingScript, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outs := spendable[hex.EncodeToString(pay.ID)]; len(outs) != 1 || outs[0] != 1 {
+		t.Errorf("spendable outputs of the payment = %v, want [1]", outs)
+	}
+
+	// Block 3: alice spends output 1 alone
+	spendAlice := &Transaction{
+		Inputs:  []TxInput{{ID: pay.ID, Out: 1}},
+		Outputs: []TxOutput{*mustNewTxOutput(t, 30, address(carol), chain)},
+	}
+	if err := chain.SignTransaction(spendAlice, alice.PrivateKey, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	block3 := mineTransactions(t, chain, alice, spendAlice)
+
+	if _, err := u.GetUTXO(pay.ID, 1); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("spent output 1 is still unspent: %v", err)
+	}
+	if spendable, _, err := u.Balance(address(carol)); err != nil || spendable != 35 {
+		t.Errorf("balance of carol = %d, %v; want 35", spendable, err)
+	}
+
+	// Replaying the chain rebuilds the same set
+	count, err := u.CountUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if reindexed, err := u.CountUTXO(); err != nil || reindexed != count {
+		t.Errorf("reindexed set has %d outputs, %v; want %d", reindexed, err, count)
+	}
+
+	// Disconnecting block 3 restores output 1 as it was
+	if err := chain.InvalidateBlock(block3.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := u.GetUTXO(pay.ID, 1); err != nil || entry.Output.Value != 30 || entry.Height != 1 {
+		t.Errorf("restored output 1 = %+v, %v; want value 30 at height 1", entry, err)
+	}
+	if _, err := u.GetUTXO(pay.ID, 0); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("output 0 spent in block 2 came back: %v", err)
+	}
+}
+
+func mustNewTxOutput(t *testing.T, value int, address string, chain *Blockchain) *TxOutput {
+	t.Helper()
+
+	out, err := NewTxOutput(value, address, chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+func TestDisconnectChainedSpend(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+	bob, carol := wallet.CreateWallet(), wallet.CreateWallet()
+	u := UTXOSet{chain}
+	address := func(w *wallet.Wallet) string { return string(w.Address(chain.Params.AddressVersion)) }
+
+	before, err := u.CountUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent and the child spending it are mined in the same block
+	pool := NewMempool(chain, DefaultMaxMempoolSize)
+	parent, err := pool.NewTransaction(alice, address(bob), 20, Fee{}, PaymentLock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddTransaction(parent); err != nil {
+		t.Fatal(err)
+	}
+	child, err := pool.NewTransaction(bob, address(carol), 20, Fee{}, PaymentLock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddTransaction(child); err != nil {
+		t.Fatal(err)
+	}
+	block, err := pool.MineBlock(context.Background(), address(alice), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 3 {
+		t.Fatalf("block has %d transactions, want 3", len(block.Transactions))
+	}
+	if _, err := u.GetUTXO(parent.ID, 0); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("output spent within the block is unspent: %v", err)
+	}
+
+	if err := chain.InvalidateBlock(block.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := u.CountUTXO(); err != nil || after != before {
+		t.Errorf("UTXO set has %d outputs after disconnecting, %v; want %d", after, err, before)
+	}
+	for _, tx := range []*Transaction{parent, child} {
+		for out := range tx.Outputs {
+			if _, err := u.GetUTXO(tx.ID, out); !errors.Is(err, ErrTxNotFound) {
+				t.Errorf("output %x:%d of the disconnected block is unspent: %v", tx.ID, out, err)
+			}
+		}
+	}
+	if entry, err := u.GetUTXO(parent.Inputs[0].ID, parent.Inputs[0].Out); err != nil || entry.Output.Value != 50 {
+		t.Errorf("output spent by the parent = %+v, %v; want it restored", entry, err)
+	}
+}
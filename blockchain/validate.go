@@ -0,0 +1,249 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bahadylbekov/go-blockchain/script"
+	badger "github.com/dgraph-io/badger"
+)
+
+// maxFutureBlockTime is how far ahead of the local clock a block timestamp may be
+const maxFutureBlockTime = 2 * time.Hour
+
+func invalidBlock(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidBlock, fmt.Sprintf(format, a...))
+}
+
+func outpoint(txID []byte, out int) string {
+	return fmt.Sprintf("%x:%d", txID, out)
+}
+
+// findBranchTransaction looks up a transaction and the block holding it in
+// the chain ending at the block with hash tipHash, using the transaction
+// index when it is enabled
+func findBranchTransaction(txn *badger.Txn, tipHash, txID []byte) (*Transaction, *Block, error) {
+	if indexed, err := hasTxIndex(txn); err != nil {
+		return nil, nil, err
+	} else if indexed {
+		return findIndexedTransaction(txn, txID)
+	}
+
+	for hash := tipHash; len(hash) > 0; {
+		block, err := getBlock(txn, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, txID) {
+				return tx, block, nil
+			}
+		}
+
+		hash = block.PrevBlockHash
+	}
+
+	return nil, nil, fmt.Errorf("%w: %x", ErrTxNotFound, txID)
+}
+
+// ValidateBlock checks that block may be connected on top of the current tip.
+// The returned error wraps ErrInvalidBlock and describes the broken rule.
+func (chain *Blockchain) ValidateBlock(block *Block) error {
+	if !bytes.Equal(block.PrevBlockHash, chain.LastHash) {
+		return invalidBlock("previous block %x is not the chain tip %x", block.PrevBlockHash, chain.LastHash)
+	}
+
+	return chain.Database.View(func(txn *badger.Txn) error {
+		parent, err := getBlockNode(txn, chain.LastHash)
+		if err != nil {
+			return err
+		}
+		if err := chain.checkBlockSanity(txn, block, parent); err != nil {
+			return err
+		}
+
+		return chain.checkBlockContext(txn, block)
+	})
+}
+
+// checkBlockSanity runs the checks that only need the block and the block
+// index of its branch
+func (chain *Blockchain) checkBlockSanity(txn *badger.Txn, block *Block, parent *BlockNode) error {
+	if len(block.Transactions) == 0 {
+		return invalidBlock("block %x has no transactions", block.Hash)
+	}
+
+	if block.Height != parent.Height+1 {
+		return invalidBlock("block height %d does not follow the parent height %d", block.Height, parent.Height)
+	}
+	if block.Version < 1 {
+		return invalidBlock("block version %d is not supported", block.Version)
+	}
+	requiredBits, err := chain.calcNextRequiredBits(txn, parent)
+	if err != nil {
+		return err
+	}
+	if block.Bits != requiredBits {
+		return invalidBlock("block bits %08x do not match the required %08x", block.Bits, requiredBits)
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return invalidBlock("merkle root %x does not match the transactions", block.MerkleRoot)
+	}
+	if !bytes.Equal(block.WitnessRoot, block.HashWitnesses()) {
+		return invalidBlock("witness root %x does not match the transactions", block.WitnessRoot)
+	}
+
+	pow := NewProofOfWork(block)
+	if !bytes.Equal(pow.Hash(), block.Hash) {
+		return invalidBlock("block hash %x does not match its contents", block.Hash)
+	}
+	if !pow.Validate(requiredBits) {
+		return invalidBlock("block %x does not satisfy proof of work", block.Hash)
+	}
+
+	if block.Timestamp > time.Now().Add(maxFutureBlockTime).Unix() {
+		return invalidBlock("block timestamp %d is too far in the future", block.Timestamp)
+	}
+	medianTime, err := medianTimePast(txn, parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= medianTime {
+		return invalidBlock("block timestamp %d is not after the median time past %d", block.Timestamp, medianTime)
+	}
+
+	// The Merkle tree repeats the last node of odd levels, so a block whose
+	// trailing transactions are duplicated has the same root and hash as the
+	// genuine one. Rejecting duplicates keeps such a copy from being stored
+	// in its place.
+	seen := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if i == 0 && !tx.IsCoinBase() {
+			return invalidBlock("first transaction is not a coinbase")
+		}
+		if i > 0 && tx.IsCoinBase() {
+			return invalidBlock("transaction %x is an extra coinbase", tx.ID)
+		}
+		if !bytes.Equal(tx.ID, tx.Hash()) {
+			return invalidBlock("transaction %x has a wrong ID", tx.ID)
+		}
+		if seen[hex.EncodeToString(tx.ID)] {
+			return invalidBlock("transaction %x appears twice in the block", tx.ID)
+		}
+		seen[hex.EncodeToString(tx.ID)] = true
+		if len(tx.Outputs) == 0 {
+			return invalidBlock("transaction %x has no outputs", tx.ID)
+		}
+		for _, out := range tx.Outputs {
+			if out.Value < 0 {
+				return invalidBlock("transaction %x has a negative output", tx.ID)
+			}
+			if !out.IsValidData() {
+				return invalidBlock("transaction %x has a data output over %d bytes", tx.ID, script.MaxDataCarrierSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkBlockContext checks the transactions of block against the chain
+// ending at its parent
+func (chain *Blockchain) checkBlockContext(txn *badger.Txn, block *Block) error {
+	spent := make(map[string]bool)
+	blockTXs := make(map[string]Transaction)
+	fees := 0
+
+	parent, err := getBlockNode(txn, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	lockTimeCutoff, err := medianTimePast(txn, parent)
+	if err != nil {
+		return err
+	}
+	locks := &lockState{parent, lockTimeCutoff}
+
+	for _, tx := range block.Transactions {
+		if !tx.IsFinal(block.Height, lockTimeCutoff) {
+			return invalidBlock("transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+		if !tx.IsCoinBase() {
+			fee, err := chain.checkTransactionInputs(txn, block, locks, tx, spent, blockTXs)
+			if err != nil {
+				return err
+			}
+			fees += fee
+		}
+
+		blockTXs[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	subsidy := chain.Params.BlockSubsidy(block.Height)
+	if reward := block.Transactions[0].OutputValue(); reward > subsidy+fees {
+		return invalidBlock("coinbase pays %d, more than the block subsidy %d plus fees %d", reward, subsidy, fees)
+	}
+
+	return nil
+}
+
+// checkTransactionInputs validates the inputs of one transaction of a block,
+// including their relative locks, and returns its fee. spent and blockTXs
+// carry the outputs consumed and the transactions created earlier in the block.
+func (chain *Blockchain) checkTransactionInputs(txn *badger.Txn, block *Block, locks *lockState, tx *Transaction, spent map[string]bool, blockTXs map[string]Transaction) (int, error) {
+	prevOuts := make(map[string]TxOutput)
+	inputValue := 0
+
+	for _, in := range tx.Inputs {
+		key := outpoint(in.ID, in.Out)
+		if spent[key] {
+			return 0, invalidBlock("output %s is spent twice in the block", key)
+		}
+		spent[key] = true
+
+		var output TxOutput
+		height := block.Height
+		prevTx, inBlock := blockTXs[hex.EncodeToString(in.ID)]
+		if inBlock {
+			if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return 0, invalidBlock("transaction %x spends a missing output %s", tx.ID, key)
+			}
+			output = prevTx.Outputs[in.Out]
+		} else {
+			entry, err := getUTXO(txn, in.ID, in.Out)
+			if errors.Is(err, ErrTxNotFound) {
+				return 0, invalidBlock("transaction %x spends %s, which is missing or already spent", tx.ID, key)
+			} else if err != nil {
+				return 0, err
+			}
+			output = entry.Output
+			height = entry.Height
+		}
+
+		if reached, err := locks.sequenceReached(txn, in.Sequence, height); err != nil {
+			return 0, err
+		} else if !reached {
+			return 0, invalidBlock("transaction %x spends %s before its relative lock %d", tx.ID, key, in.Sequence)
+		}
+
+		prevOuts[key] = output
+		inputValue += output.Value
+	}
+
+	outputValue := tx.OutputValue()
+	if outputValue > inputValue {
+		return 0, invalidBlock("transaction %x spends %d but only has %d", tx.ID, outputValue, inputValue)
+	}
+
+	if err := tx.verifyScripts(prevOuts); errors.Is(err, script.ErrScriptFailed) {
+		return 0, invalidBlock("transaction %x: %v", tx.ID, err)
+	} else if err != nil {
+		return 0, err
+	}
+
+	return inputValue - outputValue, nil
+}
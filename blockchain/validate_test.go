@@ -0,0 +1,112 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+func TestValidateBlock(t *testing.T) {
+	chain, alice, cleanup := newTestChain(t)
+	defer cleanup()
+	bob := wallet.CreateWallet()
+	u := UTXOSet{chain}
+
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.CalcNextRequiredBits(genesis.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pay and doubleSpend both spend the genesis output, with a fee of 2
+	pay, err := NewTransaction(alice, addressOn(chain, bob), 20, Fee{Amount: 2}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doubleSpend, err := NewTransaction(alice, addressOn(chain, bob), 30, Fee{Amount: 2}, PaymentLock{}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbaseFees := func(fees int) *Transaction {
+		tx, err := CoinbaseTx(addressOn(chain, alice), "", 1, fees, chain.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	coinbase, otherCoinbase := coinbaseFees(2), coinbaseFees(0)
+	wrongID := *pay
+	wrongID.ID = doubleSpend.ID
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		// before edits the block before it is mined, after once it is
+		before, after func(b *Block)
+		reason        string
+	}{
+		{"valid", []*Transaction{coinbase, pay}, nil, nil, ""},
+
+		{"height", []*Transaction{coinbase, pay}, func(b *Block) { b.Height = 2 }, nil, "does not follow the parent height"},
+		{"bits", []*Transaction{coinbase, pay}, func(b *Block) { b.Bits = 0x207fffff }, nil, "do not match the required"},
+		{"merkle root", []*Transaction{coinbase, pay}, nil, func(b *Block) {
+			b.Transactions = b.Transactions[:1]
+		}, "merkle root"},
+		{"block hash", []*Transaction{coinbase, pay}, nil, func(b *Block) {
+			b.Hash = append([]byte{b.Hash[0] ^ 0xff}, b.Hash[1:]...)
+		}, "does not match its contents"},
+		{"proof of work", []*Transaction{coinbase, pay}, nil, func(b *Block) {
+			pow := NewProofOfWork(b)
+			for b.Nonce++; pow.Validate(bits); {
+				b.Nonce++
+			}
+			b.Hash = pow.Hash()
+		}, "does not satisfy proof of work"},
+		{"timestamp at the median time past", []*Transaction{coinbase, pay}, func(b *Block) {
+			b.Timestamp = genesis.Timestamp
+		}, nil, "not after the median time past"},
+		{"timestamp in the future", []*Transaction{coinbase, pay}, func(b *Block) {
+			b.Timestamp = time.Now().Add(maxFutureBlockTime + time.Hour).Unix()
+		}, nil, "too far in the future"},
+
+		{"coinbase not first", []*Transaction{pay, coinbase}, nil, nil, "first transaction is not a coinbase"},
+		{"extra coinbase", []*Transaction{coinbase, pay, otherCoinbase}, nil, nil, "is an extra coinbase"},
+		{"duplicate transaction", []*Transaction{coinbase, pay, pay}, nil, nil, "appears twice"},
+		{"wrong transaction ID", []*Transaction{coinbase, &wrongID}, nil, nil, "has a wrong ID"},
+		{"double spend", []*Transaction{coinbase, pay, doubleSpend}, nil, nil, "is spent twice"},
+		{"coinbase overspending", []*Transaction{coinbaseFees(3), pay}, nil, nil, "more than the block subsidy"},
+		{"coinbase claiming missing fees", []*Transaction{coinbase}, nil, nil, "more than the block subsidy"},
+	}
+	for _, tt := range tests {
+		block := newBlock(time.Now().Unix(), tt.txs, genesis.Hash, 1, bits)
+		if tt.before != nil {
+			tt.before(block)
+			block.MerkleRoot = block.HashTransactions()
+			block.WitnessRoot = block.HashWitnesses()
+		}
+		if err := NewProofOfWork(block).Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if tt.after != nil {
+			tt.after(block)
+		}
+
+		err := chain.ValidateBlock(block)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidBlock) || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: got %v, want an invalid block error about %q", tt.name, err, tt.reason)
+		}
+	}
+}
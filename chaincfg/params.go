@@ -0,0 +1,176 @@
+package chaincfg
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// ChainParams describes one network: where its data lives, how its genesis
+// block looks, how its addresses are encoded and how hard blocks are to mine
+type ChainParams struct {
+	Name    string
+	DataDir string
+
+	GenesisMessage   string
+	GenesisTimestamp int64
+
+	// AddressVersion prefixes addresses of public key hashes and
+	// ScriptAddressVersion those of script hashes
+	AddressVersion       byte
+	ScriptAddressVersion byte
+
+	// PowLimit is the highest, that is easiest, target a block may have and
+	// PowLimitBits is its compact form, used by the genesis block
+	PowLimit     *big.Int
+	PowLimitBits uint32
+
+	// Difficulty is retargeted every RetargetInterval blocks so that blocks
+	// come TargetTimePerBlock apart. NoRetargeting keeps PowLimitBits forever.
+	TargetTimePerBlock time.Duration
+	RetargetInterval   int
+	NoRetargeting      bool
+
+	// BlockReward is the coinbase subsidy of the first blocks. It halves every
+	// SubsidyHalvingInterval blocks, and no more subsidy is paid once
+	// MaxSupply coins were issued.
+	BlockReward            int
+	SubsidyHalvingInterval int
+	MaxSupply              int
+}
+
+// powLimit returns the target with the given number of leading zero bits
+func powLimit(zeroBits uint) *big.Int {
+	limit := new(big.Int).Lsh(big.NewInt(1), 256-zeroBits)
+
+	return limit.Sub(limit, big.NewInt(1))
+}
+
+// MainNetParams are the parameters of the main network
+var MainNetParams = ChainParams{
+	Name:    "mainnet",
+	DataDir: "./tmp",
+
+	GenesisMessage:   "Genesis block",
+	GenesisTimestamp: 1562889600,
+
+	AddressVersion:       0x00,
+	ScriptAddressVersion: 0x05,
+
+	PowLimit:     powLimit(16),
+	PowLimitBits: 0x1f00ffff,
+
+	TargetTimePerBlock: time.Minute,
+	RetargetInterval:   60,
+
+	BlockReward:            50,
+	SubsidyHalvingInterval: 210000,
+	MaxSupply:              21000000,
+}
+
+// TestNetParams are the parameters of the public test network
+var TestNetParams = ChainParams{
+	Name:    "testnet",
+	DataDir: "./tmp/testnet",
+
+	GenesisMessage:   "Testnet genesis block",
+	GenesisTimestamp: 1562889600,
+
+	AddressVersion:       0x6f,
+	ScriptAddressVersion: 0xc4,
+
+	PowLimit:     powLimit(12),
+	PowLimitBits: 0x1f0fffff,
+
+	TargetTimePerBlock: 30 * time.Second,
+	RetargetInterval:   30,
+
+	BlockReward:            50,
+	SubsidyHalvingInterval: 210000,
+	MaxSupply:              21000000,
+}
+
+// RegTestParams are the parameters of a private regression test network,
+// where blocks are cheap enough to mine on demand
+var RegTestParams = ChainParams{
+	Name:    "regtest",
+	DataDir: "./tmp/regtest",
+
+	GenesisMessage:   "Regtest genesis block",
+	GenesisTimestamp: 1562889600,
+
+	AddressVersion:       0x6f,
+	ScriptAddressVersion: 0xc4,
+
+	PowLimit:     powLimit(4),
+	PowLimitBits: 0x200fffff,
+
+	TargetTimePerBlock: time.Second,
+	RetargetInterval:   10,
+	NoRetargeting:      true,
+
+	BlockReward:            50,
+	SubsidyHalvingInterval: 150,
+	MaxSupply:              21000000,
+}
+
+// maxHalvings is the number of halvings after which any subsidy is zero
+const maxHalvings = 63
+
+// issued returns the subsidy paid by the blocks from the genesis up to and
+// including height, ignoring MaxSupply
+func (p *ChainParams) issued(height int) int {
+	if p.SubsidyHalvingInterval <= 0 {
+		return (height + 1) * p.BlockReward
+	}
+
+	total := 0
+	eras := height / p.SubsidyHalvingInterval
+	for era := 0; era < eras && era < maxHalvings; era++ {
+		total += p.SubsidyHalvingInterval * (p.BlockReward >> uint(era))
+	}
+	if eras < maxHalvings {
+		total += (height%p.SubsidyHalvingInterval + 1) * (p.BlockReward >> uint(eras))
+	}
+
+	return total
+}
+
+// Supply returns the number of coins issued by the blocks from the genesis up
+// to and including height
+func (p *ChainParams) Supply(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	supply := p.issued(height)
+	if p.MaxSupply > 0 && supply > p.MaxSupply {
+		supply = p.MaxSupply
+	}
+
+	return supply
+}
+
+// BlockSubsidy returns the new coins the coinbase of the block at height may
+// create. The last subsidy before MaxSupply is reached is cut short.
+func (p *ChainParams) BlockSubsidy(height int) int {
+	return p.Supply(height) - p.Supply(height-1)
+}
+
+// ParamsForNetwork returns a copy of the predefined parameters with the given name
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	var params ChainParams
+
+	switch name {
+	case MainNetParams.Name:
+		params = MainNetParams
+	case TestNetParams.Name:
+		params = TestNetParams
+	case RegTestParams.Name:
+		params = RegTestParams
+	default:
+		return nil, fmt.Errorf("unknown network %q", name)
+	}
+
+	return &params, nil
+}
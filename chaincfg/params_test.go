@@ -0,0 +1,93 @@
+package chaincfg
+
+import "testing"
+
+func TestBlockSubsidy(t *testing.T) {
+	params := RegTestParams
+	interval := params.SubsidyHalvingInterval
+
+	tests := []struct {
+		height int
+		want   int
+	}{
+		{-1, 0},
+		{0, 50},
+		{interval - 1, 50},
+		{interval, 25},
+		{interval + 1, 25},
+		{2*interval - 1, 25},
+		{2 * interval, 12},
+		{5 * interval, 1},
+		{6*interval - 1, 1},
+		{6 * interval, 0},
+		{maxHalvings*interval - 1, 0},
+		{maxHalvings * interval, 0},
+		{100 * interval, 0},
+	}
+	for _, tt := range tests {
+		if got := params.BlockSubsidy(tt.height); got != tt.want {
+			t.Errorf("BlockSubsidy(%d) = %d, want %d", tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestBlockSubsidyMaxSupply(t *testing.T) {
+	// The subsidy of the 19th block is cut short to stay within the supply
+	params := RegTestParams
+	params.SubsidyHalvingInterval = 10
+	params.MaxSupply = 730
+
+	tests := []struct {
+		height  int
+		subsidy int
+		supply  int
+	}{
+		{9, 50, 500},
+		{10, 25, 525},
+		{18, 25, 725},
+		{19, 5, 730},
+		{20, 0, 730},
+		{1000, 0, 730},
+	}
+	for _, tt := range tests {
+		if got := params.BlockSubsidy(tt.height); got != tt.subsidy {
+			t.Errorf("BlockSubsidy(%d) = %d, want %d", tt.height, got, tt.subsidy)
+		}
+		if got := params.Supply(tt.height); got != tt.supply {
+			t.Errorf("Supply(%d) = %d, want %d", tt.height, got, tt.supply)
+		}
+	}
+}
+
+func TestSupplyWithinMaxSupply(t *testing.T) {
+	for _, params := range []ChainParams{MainNetParams, TestNetParams, RegTestParams} {
+		interval := params.SubsidyHalvingInterval
+		last := (maxHalvings + 1) * interval
+
+		// Every height of the short regtest schedule, the halvings of the others
+		total := 0
+		if interval <= RegTestParams.SubsidyHalvingInterval {
+			for height := 0; height <= last; height++ {
+				subsidy := params.BlockSubsidy(height)
+				if subsidy < 0 || subsidy > params.BlockReward {
+					t.Fatalf("%s: BlockSubsidy(%d) = %d", params.Name, height, subsidy)
+				}
+				total += subsidy
+			}
+		} else {
+			for era := 0; era <= maxHalvings; era++ {
+				total += params.Supply((era+1)*interval-1) - params.Supply(era*interval-1)
+			}
+		}
+
+		if supply := params.Supply(last); total != supply {
+			t.Errorf("%s: subsidies add up to %d, supply is %d", params.Name, total, supply)
+		}
+		if total > params.MaxSupply {
+			t.Errorf("%s: %d coins issued, more than %d", params.Name, total, params.MaxSupply)
+		}
+		if subsidy := params.BlockSubsidy(last); subsidy != 0 {
+			t.Errorf("%s: subsidy after the last halving = %d", params.Name, subsidy)
+		}
+	}
+}
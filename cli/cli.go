@@ -1,137 +1,1076 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
-	"runtime"
+	"os/signal"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bahadylbekov/go-blockchain/blockchain"
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/script"
 	"github.com/bahadylbekov/go-blockchain/wallet"
 )
 
+// Exit codes returned by Run
+const (
+	ExitOK = iota
+	ExitFailure
+	ExitUsage
+	ExitChainExists
+	ExitNoChain
+	ExitInsufficientFunds
+	ExitTxNotFound
+	ExitInvalidBlock
+	ExitBlockNotFound
+	ExitTxRejected
+)
+
+var (
+	errInvalidAddress     = errors.New("address is not valid")
+	errInvalidSignature   = errors.New("signature is not valid")
+	errInvalidTransaction = errors.New("transaction is not fully signed")
+	errUsage              = errors.New("invalid usage")
+)
+
 type CommandLine struct {
+	params *chaincfg.ChainParams
+}
+
+func (cli *CommandLine) printUsage() {
+	fmt.Println()
+	fmt.Println("Usage:")
+	fmt.Println()
+	fmt.Println("Every command accepts -network mainnet|testnet|regtest and -datadir DIR")
+	fmt.Println()
+	fmt.Println("getbalance -address ADDRESS - Get the balance of address")
+	fmt.Println("createblockchain -address ADDRESS [-txindex] - Create new blockchain and init account by address")
+	fmt.Println("chaindata - Print all blockchain data")
+	fmt.Println("getblock -height HEIGHT | -hash HASH - Print one block")
+	fmt.Println("send -from FROM -to TO -amount AMOUNT [-fee FEE | -feerate RATE] [-locktime HEIGHT|TIME | -relativelock BLOCKS | -relativetime SECONDS] - Queue a payment from one account to another account, optionally locked")
+	fmt.Println("mine -address ADDRESS [-blocks N] - Mine N blocks with the queued payments, paying the reward to address")
+	fmt.Println("createwallet - Create new wallet addresss")
+	fmt.Println("addresses - List of all addresses in the blockchain network")
+	fmt.Println("reindexUTXO - Rebuild the UTXO set")
+	fmt.Println("reindextx - Build or rebuild the transaction index and keep it enabled")
+	fmt.Println("invalidateblock -hash HASH - Mark a block invalid and roll the chain back past it")
+	fmt.Println("supply [-height HEIGHT] - Print the coins issued up to height, the chain tip by default")
+	fmt.Println("signmessage -address ADDRESS -message MESSAGE - Sign a message with the key of address")
+	fmt.Println("verifymessage -address ADDRESS -signature SIGNATURE -message MESSAGE - Check a message signature")
+	fmt.Println("getpubkey -address ADDRESS - Print the public key of a wallet address")
+	fmt.Println("createmultisig -required M -pubkeys KEY,KEY,... - Create the script address of an M-of-N multisig")
+	fmt.Println("spendmultisig -redeemscript SCRIPT -to TO -amount AMOUNT [-fee FEE] - Create an unsigned payment from a multisig address")
+	fmt.Println("signmultisig -tx TX -address ADDRESS [-sighash TYPE] - Add the signature of address to a multisig payment")
+	fmt.Println("sendmultisig -tx TX - Queue a fully signed multisig payment")
+	fmt.Println("initiate -from FROM -to TO -amount AMOUNT [-locktime TIME] [-fee FEE] - Start an atomic swap with a new secret, refundable after 48 hours by default")
+	fmt.Println("participate -from FROM -to TO -amount AMOUNT -secrethash HASH [-locktime TIME] [-fee FEE] - Answer an atomic swap, refundable after 24 hours by default")
+	fmt.Println("redeem -contract CONTRACT -contracttx TXID -secret SECRET -address ADDRESS [-fee FEE] - Claim a swap contract with its secret")
+	fmt.Println("refund -contract CONTRACT -contracttx TXID -address ADDRESS [-fee FEE] - Take back a swap contract after its lock time")
+	fmt.Println("extractsecret -tx TXID -secrethash HASH - Print the secret revealed by a redeem transaction")
+	fmt.Println("notarize -file PATH -address ADDRESS [-fee FEE] - Anchor the SHA-256 hash of a file in the chain")
+	fmt.Println("verifynotary -file PATH - Show the block anchoring a file and its Merkle inclusion proof")
+	fmt.Println("createpsbt (-from FROM | -redeemscript SCRIPT) -to TO -amount AMOUNT [-fee FEE] - Create an unsigned transaction to sign offline")
+	fmt.Println("signpsbt -psbt PSBT [-sighash TYPE] - Sign a partial transaction with the keys of the wallet file only")
+	fmt.Println("combinepsbt -psbts PSBT,PSBT,... - Merge the signatures of copies of a partial transaction")
+	fmt.Println("finalizepsbt -psbt PSBT - Print the signed transaction of a fully signed partial transaction")
+	fmt.Println("broadcastpsbt -psbt PSBT - Queue the signed transaction of a fully signed partial transaction")
+	fmt.Println(`createrawtx -inputs '[{"txid":TXID,"vout":N}]' -outputs '[{"address":ADDRESS,"amount":N},{"data":HEX}]' [-locktime TIME] - Create an unsigned transaction`)
+	fmt.Println("signrawtx -tx TX -address ADDRESS [-sighash TYPE] - Sign the inputs of a raw transaction that address can sign")
+	fmt.Println("decoderawtx -tx TX - Print a raw transaction as JSON")
+	fmt.Println("gettx -id TXID - Print a transaction with its block and confirmations as JSON")
+	fmt.Println("sendrawtx -tx TX - Queue a signed raw transaction")
+	fmt.Println()
+}
+
+// exitCode maps errors returned by the blockchain package to process exit codes
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case err == errUsage:
+		return ExitUsage
+	case errors.Is(err, blockchain.ErrChainExists):
+		return ExitChainExists
+	case errors.Is(err, blockchain.ErrNoChain):
+		return ExitNoChain
+	case errors.Is(err, blockchain.ErrInsufficientFunds):
+		return ExitInsufficientFunds
+	case errors.Is(err, blockchain.ErrTxNotFound):
+		return ExitTxNotFound
+	case errors.Is(err, blockchain.ErrInvalidBlock):
+		return ExitInvalidBlock
+	case errors.Is(err, blockchain.ErrBlockNotFound):
+		return ExitBlockNotFound
+	case errors.Is(err, blockchain.ErrTxRejected), errors.Is(err, blockchain.ErrTxConflict):
+		return ExitTxRejected
+	default:
+		return ExitFailure
+	}
+}
+
+func (cli *CommandLine) printBlockchain() error {
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+
+		if err := printBlock(chain, block); err != nil {
+			return err
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+func printBlock(chain *blockchain.Blockchain, block *blockchain.Block) error {
+	requiredBits, err := chain.CalcNextRequiredBits(block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Prev. Hash: %x\n", block.PrevBlockHash)
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Printf("Merkle Root: %x\n", block.MerkleRoot)
+	fmt.Printf("Witness Root: %x\n", block.WitnessRoot)
+	fmt.Printf("Timestamp: %d\n", block.Timestamp)
+	fmt.Printf("Bits: %08x\n", block.Bits)
+	pow := blockchain.NewProofOfWork(block)
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate(requiredBits)))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+
+	return nil
+}
+
+func (cli *CommandLine) getBlock(height int, hash string) error {
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	var block *blockchain.Block
+	if hash != "" {
+		blockHash, err := hex.DecodeString(hash)
+		if err != nil {
+			return err
+		}
+		block, err = chain.GetBlockByHash(blockHash)
+	} else {
+		block, err = chain.GetBlockByHeight(height)
+	}
+	if err != nil {
+		return err
+	}
+
+	return printBlock(chain, block)
+}
+
+func (cli *CommandLine) createBlockchain(address string, txIndex bool) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	chain, err := blockchain.InitBlockchain(address, cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
+
+	if txIndex {
+		if _, err := chain.ReindexTransactions(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Blockchain created by %s\n", address)
+	return nil
+}
+
+// validPayee reports whether address is a key or a script address of the network
+func (cli *CommandLine) validPayee(address string) bool {
+	return wallet.ValidateAddress(address, cli.params.AddressVersion) ||
+		wallet.ValidateAddress(address, cli.params.ScriptAddressVersion)
+}
+
+func (cli *CommandLine) getBalance(address string) error {
+	if !cli.validPayee(address) {
+		return errInvalidAddress
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	spendable, locked, err := UTXOSet.Balance(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Balance of %s: %d\n", address, spendable+locked)
+	fmt.Printf("Spendable: %d\n", spendable)
+	fmt.Printf("Locked: %d\n", locked)
+	return nil
+}
+
+func (cli *CommandLine) reindexUTXO() error {
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
+
+	count, err := UTXOSet.CountUTXO()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d unspent outputs in the UTXO set. \n", count)
+	return nil
+}
+
+func (cli *CommandLine) reindexTransactions() error {
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	count, err := chain.ReindexTransactions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the transaction index. \n", count)
+	return nil
+}
+
+func (cli *CommandLine) invalidateBlock(hash string) error {
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	// The pool takes back the transactions of the disconnected blocks
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	if err := chain.InvalidateBlock(blockHash); err != nil {
+		return err
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Block %s invalidated, the tip is now %x at height %d\n", hash, chain.LastHash, height)
+	return pool.SaveFile()
+}
+
+// send builds and signs a payment and queues it in the pending pool. It is
+// confirmed by the next mined block.
+func (cli *CommandLine) send(from, to string, amount int, fee blockchain.Fee, lock blockchain.PaymentLock) error {
+	if !wallet.ValidateAddress(from, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	if !cli.validPayee(to) {
+		return errInvalidAddress
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pool.NewTransaction(&w, to, amount, fee, lock)
+	if err != nil {
+		return err
+	}
+	if err := pool.AddTransaction(tx); err != nil {
+		return err
+	}
+	if err := pool.SaveFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Queued transaction %x: %d from %s to %s\n", tx.ID, amount, from, to)
+	return nil
+}
+
+// mine mines blocks from the pending pool, paying the block rewards to address
+func (cli *CommandLine) mine(address string, blocks int) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for i := 0; i < blocks; i++ {
+		block, err := pool.MineBlock(ctx, address, printMiningProgress)
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mined block %x at height %d with %d transactions\n", block.Hash, block.Height, len(block.Transactions))
+	}
+
+	return pool.SaveFile()
+}
+
+func printMiningProgress(progress blockchain.MiningProgress) {
+	fmt.Printf("\rMining: %d hashes in %s, %.0f H/s", progress.Hashes, progress.Elapsed.Round(time.Millisecond), progress.HashRate)
+}
+
+func (cli *CommandLine) supply(height int) error {
+	if height < 0 {
+		chain, err := blockchain.ContinueBlockchain(cli.params)
+		if err != nil {
+			return err
+		}
+		height, err = chain.GetBestHeight()
+		chain.Database.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Block subsidy: %d\n", cli.params.BlockSubsidy(height))
+	fmt.Printf("Issued: %d of %d\n", cli.params.Supply(height), cli.params.MaxSupply)
+	return nil
+}
+
+// signMessage prints the public key of address followed by the signature, so
+// that verifyMessage can check both against the address alone
+func (cli *CommandLine) signMessage(address, message string) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	signature, err := wallet.SignMessage(&w.PrivateKey, []byte(message))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signature: %x%x\n", w.PublicKey, signature)
+	return nil
+}
+
+func (cli *CommandLine) verifyMessage(address, signature, message string) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	data, err := hex.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	if len(data) != wallet.PublicKeyLength+wallet.SignatureLength {
+		return errInvalidSignature
+	}
+	pubKey, sig := data[:wallet.PublicKeyLength], data[wallet.PublicKeyLength:]
+
+	if !bytes.Equal(wallet.PublicKeyHash(pubKey), wallet.AddressHash(address)) || !wallet.VerifyMessage(pubKey, []byte(message), sig) {
+		return errInvalidSignature
+	}
+
+	fmt.Printf("Signature is valid for %s\n", address)
+	return nil
+}
+
+func (cli *CommandLine) getPubKey(address string) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Public key: %x\n", w.PublicKey)
+	return nil
+}
+
+// createMultiSig prints the script address paying to required of pubKeys and
+// the redeem script that spends from it
+func (cli *CommandLine) createMultiSig(required int, pubKeys string) error {
+	var keys [][]byte
+	for _, key := range strings.Split(pubKeys, ",") {
+		pubKey, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return err
+		}
+		if _, err := wallet.ParsePublicKey(pubKey); err != nil {
+			return err
+		}
+		keys = append(keys, pubKey)
+	}
+
+	redeemScript, err := script.MultiSigScript(required, keys)
+	if err != nil {
+		return err
+	}
+	disassembly, err := script.Disassemble(redeemScript)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Address: %s\n", wallet.ScriptAddress(redeemScript, cli.params.ScriptAddressVersion))
+	fmt.Printf("Redeem script: %x\n", redeemScript)
+	fmt.Printf("Script: %s\n", disassembly)
+	return nil
+}
+
+// spendMultiSig prints an unsigned payment from the script address of
+// redeemScript, to be passed around the key holders by signMultiSig
+func (cli *CommandLine) spendMultiSig(redeemScript, to string, amount, fee int) error {
+	if !cli.validPayee(to) {
+		return errInvalidAddress
+	}
+
+	redeem, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	tx, err := pool.NewMultiSigTransaction(redeem, false, to, amount, fee)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+	return nil
+}
+
+func (cli *CommandLine) signMultiSig(txHex, address, sigHash string) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+	hashType, err := blockchain.ParseSigHashType(sigHash)
+	if err != nil {
+		return err
+	}
+
+	tx, err := decodeTransaction(txHex)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	signed, err := chain.SignMultiSigTransaction(tx, w.PrivateKey, hashType)
+	if err != nil {
+		return err
+	}
+	complete, err := chain.VerifyTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Signed %d of %d inputs\n", signed, len(tx.Inputs))
+	fmt.Printf("Complete: %t\n", complete)
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+	return nil
+}
+
+// queueTransaction adds the signed transaction tx to the pool
+func (cli *CommandLine) queueTransaction(tx *blockchain.Transaction) error {
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	valid, err := chain.VerifyTransaction(tx)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errInvalidTransaction
+	}
+	if err := pool.AddTransaction(tx); err != nil {
+		return err
+	}
+	if err := pool.SaveFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Queued transaction %x\n", tx.ID)
+	return nil
+}
+
+// Default lock times of swap contracts. The initiator reveals the secret, so
+// its contract must outlive the one of the participant.
+const (
+	initiateLockTime    = 48 * time.Hour
+	participateLockTime = 24 * time.Hour
+)
+
+// fundContract queues a payment from the wallet of from to a new hash
+// time-locked contract paying to on the secret of secretHash, refundable to
+// from after lockTime
+func (cli *CommandLine) fundContract(from, to string, amount, fee int, secretHash []byte, lockTime int64) error {
+	if !wallet.ValidateAddress(from, cli.params.AddressVersion) || !wallet.ValidateAddress(to, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	contract, err := blockchain.NewHTLC(secretHash, to, lockTime, from, cli.params)
+	if err != nil {
+		return err
+	}
+	contractAddress := string(wallet.ScriptAddress(contract, cli.params.ScriptAddressVersion))
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pool.NewTransaction(&w, contractAddress, amount, blockchain.Fee{Amount: fee}, blockchain.PaymentLock{})
+	if err != nil {
+		return err
+	}
+	if err := pool.AddTransaction(tx); err != nil {
+		return err
+	}
+	if err := pool.SaveFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Secret hash: %x\n", secretHash)
+	fmt.Printf("Lock time: %d\n", lockTime)
+	fmt.Printf("Contract: %x\n", contract)
+	fmt.Printf("Contract address: %s\n", contractAddress)
+	fmt.Printf("Contract transaction: %x\n", tx.ID)
+	return nil
+}
+
+func (cli *CommandLine) initiate(from, to string, amount, fee int, lockTime int64) error {
+	secret, secretHash, err := blockchain.NewSecret()
+	if err != nil {
+		return err
+	}
+	if lockTime == 0 {
+		lockTime = time.Now().Add(initiateLockTime).Unix()
+	}
+
+	if err := cli.fundContract(from, to, amount, fee, secretHash, lockTime); err != nil {
+		return err
+	}
+	fmt.Printf("Secret: %x\n", secret)
+	return nil
+}
+
+func (cli *CommandLine) participate(from, to string, amount, fee int, secretHash string, lockTime int64) error {
+	hash, err := hex.DecodeString(secretHash)
+	if err != nil {
+		return err
+	}
+	if lockTime == 0 {
+		lockTime = time.Now().Add(participateLockTime).Unix()
+	}
+
+	return cli.fundContract(from, to, amount, fee, hash, lockTime)
+}
+
+// spendContract queues the redeem or refund transaction of a swap contract
+// built by spend with the wallet of address
+func (cli *CommandLine) spendContract(contractHex, contractTx, address string, spend func(chain *blockchain.Blockchain, contract, contractTxID []byte, w *wallet.Wallet) (*blockchain.Transaction, error)) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+	contract, err := hex.DecodeString(contractHex)
+	if err != nil {
+		return err
+	}
+	contractTxID, err := hex.DecodeString(contractTx)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	tx, err := spend(chain, contract, contractTxID, &w)
+	if err != nil {
+		return err
+	}
+	if err := pool.AddTransaction(tx); err != nil {
+		return err
+	}
+	if err := pool.SaveFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Queued transaction %x: %d to %s\n", tx.ID, tx.OutputValue(), address)
+	return nil
 }
 
-func HandleErr(err error) {
+func (cli *CommandLine) redeem(contract, contractTx, secret, address string, fee int) error {
+	preimage, err := hex.DecodeString(secret)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	return cli.spendContract(contract, contractTx, address, func(chain *blockchain.Blockchain, contract, contractTxID []byte, w *wallet.Wallet) (*blockchain.Transaction, error) {
+		return chain.RedeemHTLC(contract, contractTxID, preimage, w, fee)
+	})
 }
 
-func (cli *CommandLine) printUsage() {
-	fmt.Println()
-	fmt.Println("Usage:")
-	fmt.Println()
-	fmt.Println("getbalance -address ADDRESS - Get the balance of address")
-	fmt.Println("createblockchain -address ADDRESS - Create new blockchain and init account by address")
-	fmt.Println("chaindata - Print all blockchain data")
-	fmt.Println("transfer -from FROM -to TO -amount AMOUNT - Transfer money from one account to another account")
-	fmt.Println("createwallet - Create new wallet addresss")
-	fmt.Println("addresses - List of all addresses in the blockchain network")
-	fmt.Println("reindexUTXO - Rebuild the UTXO set")
-	fmt.Println()
+func (cli *CommandLine) refund(contract, contractTx, address string, fee int) error {
+	return cli.spendContract(contract, contractTx, address, func(chain *blockchain.Blockchain, contract, contractTxID []byte, w *wallet.Wallet) (*blockchain.Transaction, error) {
+		return chain.RefundHTLC(contract, contractTxID, w, fee)
+	})
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
-		cli.printUsage()
-		runtime.Goexit()
+// extractSecret prints the secret revealed by the redeem transaction txID,
+// mined or pending
+func (cli *CommandLine) extractSecret(txID, secretHash string) error {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		return err
+	}
+	hash, err := hex.DecodeString(secretHash)
+	if err != nil {
+		return err
 	}
-}
 
-func (cli *CommandLine) printBlockchain() {
-	chain := blockchain.ContinueBlockchain("")
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
-	iter := chain.Iterator()
 
-	for {
-		block := iter.Next()
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
 
-		fmt.Printf("Prev. Hash: %x\n", block.PrevBlockHash)
-		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := blockchain.NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+	tx, ok := pool.Transaction(id)
+	if !ok {
+		found, err := chain.FindTransaction(id)
+		if err != nil {
+			return err
 		}
-		fmt.Println()
+		tx = &found
+	}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+	secret, err := blockchain.ExtractSecret(tx, hash)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Secret: %x\n", secret)
+	return nil
+}
+
+// hashFile returns the SHA-256 hash of the file at path
+func hashFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
+	hash := sha256.Sum256(data)
+
+	return hash[:], nil
 }
 
-func (cli *CommandLine) createBlockchain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not valid")
+// notarize queues a transaction from the wallet of address anchoring the
+// hash of the file at path in a data output
+func (cli *CommandLine) notarize(path, address string, fee int) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
 	}
 
-	chain := blockchain.InitBlockchain(address)
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
 
-	fmt.Printf("Blockchain created by %s\n", address)
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pool.NewDataTransaction(&w, hash, blockchain.Fee{Amount: fee})
+	if err != nil {
+		return err
+	}
+	if err := pool.AddTransaction(tx); err != nil {
+		return err
+	}
+	if err := pool.SaveFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("File hash: %x\n", hash)
+	fmt.Printf("Queued transaction %x\n", tx.ID)
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not valid")
+// verifyNotary prints the block anchoring the hash of the file at path and
+// the Merkle proof that commits the block to the anchoring transaction
+func (cli *CommandLine) verifyNotary(path string) error {
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
 	}
 
-	chain := blockchain.ContinueBlockchain(address)
-	UTXOSet := blockchain.UTXOSet{chain}
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	fmt.Printf("File hash: %x\n", hash)
+
+	tx, block, err := chain.FindDataTransaction(hash)
+	if errors.Is(err, blockchain.ErrTxNotFound) {
+		pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+		if err := pool.LoadFile(); err != nil {
+			return err
+		}
+		for _, pending := range pool.Transactions() {
+			if pending.CarriesData(hash) {
+				return fmt.Errorf("transaction %x anchoring the file is not mined yet", pending.ID)
+			}
+		}
+		return errors.New("file is not notarized")
+	} else if err != nil {
+		return err
+	}
 
-	for _, out := range UTXOs {
-		balance += out.Value
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	proof, err := block.MerkleProof(tx.ID)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Transaction: %x\n", tx.ID)
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Timestamp: %d (%s)\n", block.Timestamp, time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Confirmations: %d\n", height-block.Height+1)
+	fmt.Printf("Merkle Root: %x\n", block.MerkleRoot)
+	fmt.Printf("Merkle Proof: position %d of %d transactions\n", proof.Index, len(block.Transactions))
+	for i, sibling := range proof.Siblings {
+		side := "right"
+		if proof.Index>>uint(i)&1 == 1 {
+			side = "left"
+		}
+		fmt.Printf("  %-5s %x\n", side, sibling)
+	}
+	fmt.Printf("Proof: %s\n", strconv.FormatBool(proof.Verify(tx.ID, block.MerkleRoot)))
+	return nil
 }
 
-func (cli *CommandLine) reindexUTXO() {
-	chain := blockchain.ContinueBlockchain("")
+// createPSBT prints a partial transaction paying amount to the address to
+// from the key address from or, if redeemScript is set, from its script
+// address
+func (cli *CommandLine) createPSBT(from, redeemScript, to string, amount, fee int) error {
+	if !cli.validPayee(to) {
+		return errInvalidAddress
+	}
+	if redeemScript == "" && !wallet.ValidateAddress(from, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
 
-	count := UTXOSet.CountUTXO()
-	fmt.Printf("Done! There are %d transactions in the UTXO set. \n", count)
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	var pt *blockchain.PartialTransaction
+	if redeemScript != "" {
+		redeem, err := hex.DecodeString(redeemScript)
+		if err != nil {
+			return err
+		}
+		tx, err := pool.NewMultiSigTransaction(redeem, false, to, amount, fee)
+		if err != nil {
+			return err
+		}
+		if pt, err = chain.NewPartialTransaction(tx); err != nil {
+			return err
+		}
+	} else {
+		pt, err = pool.CreatePartialTransaction(from, to, amount, blockchain.Fee{Amount: fee}, blockchain.PaymentLock{})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Fee: %d\n", pt.Fee())
+	fmt.Printf("PSBT: %x\n", pt.Serialize())
+	return nil
+}
+
+// signPSBT signs a partial transaction with the wallet file alone, without
+// opening the chain
+func (cli *CommandLine) signPSBT(psbt, sigHash string) error {
+	pt, err := decodePSBT(psbt)
+	if err != nil {
+		return err
+	}
+	hashType, err := blockchain.ParseSigHashType(sigHash)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	signed, err := pt.Sign(wallets, hashType)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(pt.Tx)
+	fmt.Printf("Fee: %d\n", pt.Fee())
+	fmt.Printf("Signed %d of %d inputs\n", signed, len(pt.Inputs))
+	fmt.Printf("PSBT: %x\n", pt.Serialize())
+	return nil
+}
+
+func (cli *CommandLine) combinePSBT(psbts string) error {
+	var combined *blockchain.PartialTransaction
+	for _, psbt := range strings.Split(psbts, ",") {
+		pt, err := decodePSBT(strings.TrimSpace(psbt))
+		if err != nil {
+			return err
+		}
+		if combined == nil {
+			combined = pt
+		} else if err := combined.Combine(pt); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("PSBT: %x\n", combined.Serialize())
+	return nil
+}
+
+func (cli *CommandLine) finalizePSBT(psbt string) error {
+	pt, err := decodePSBT(psbt)
+	if err != nil {
+		return err
+	}
+	tx, err := pt.Finalize()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+	return nil
 }
 
-func (cli *CommandLine) transfer(from, to string, amount int) {
-	if !wallet.ValidateAddress(from) {
-		log.Panic("Address is not valid")
+func (cli *CommandLine) broadcastPSBT(psbt string) error {
+	pt, err := decodePSBT(psbt)
+	if err != nil {
+		return err
+	}
+	tx, err := pt.Finalize()
+	if err != nil {
+		return err
 	}
 
-	if !wallet.ValidateAddress(to) {
-		log.Panic("Address is not valid")
+	return cli.queueTransaction(tx)
+}
+
+func decodePSBT(psbt string) (*blockchain.PartialTransaction, error) {
+	data, err := hex.DecodeString(psbt)
+	if err != nil {
+		return nil, err
 	}
 
-	chain := blockchain.ContinueBlockchain(from)
-	UTXOSet := blockchain.UTXOSet{chain}
-	defer chain.Database.Close()
+	return blockchain.DeserializePartialTransaction(data)
+}
+
+func decodeTransaction(txHex string) (*blockchain.Transaction, error) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
 
-	tx := blockchain.NewTransaction(from, to, amount, &UTXOSet)
-	cbTx := blockchain.CoinbaseTx(from, "")
-	block := chain.AddBlock([]*blockchain.Transaction{cbTx, tx})
-	UTXOSet.Update(block)
-	fmt.Printf("Successfully transfered: %d from %s to %s\n", amount, from, to)
+	return blockchain.DeserializeTransaction(data)
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) listAddresses() error {
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
 	addresses := wallets.GetAllAddresses()
 	fmt.Println()
 
@@ -139,105 +1078,529 @@ func (cli *CommandLine) listAddresses() {
 		fmt.Println(address)
 	}
 	fmt.Println()
+	return nil
 }
 
-func (cli *CommandLine) createWallet() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) createWallet() error {
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
 	address := wallets.AddWallet()
 
-	wallets.SaveFile()
+	if err := wallets.SaveFile(); err != nil {
+		return err
+	}
 	fmt.Printf("New Wallet created: %s\n", address)
+	return nil
 }
 
-func (cli *CommandLine) Run() {
-	cli.validateArgs()
+// Run parses the command line, executes the requested command and returns
+// the process exit code
+func (cli *CommandLine) Run() int {
+	if len(os.Args) < 2 {
+		cli.printUsage()
+		return ExitUsage
+	}
+
+	err := cli.run(os.Args[1], os.Args[2:])
+	if err != nil && err != errUsage {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+
+	return exitCode(err)
+}
 
+func (cli *CommandLine) run(command string, args []string) error {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
-	transferCmd := flag.NewFlagSet("transfer", flag.ExitOnError)
+	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
 	chainDataCmd := flag.NewFlagSet("chaindata", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	addressesCmd := flag.NewFlagSet("addresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
+	signMessageCmd := flag.NewFlagSet("signmessage", flag.ExitOnError)
+	verifyMessageCmd := flag.NewFlagSet("verifymessage", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultiSigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	spendMultiSigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
+	signMultiSigCmd := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	sendMultiSigCmd := flag.NewFlagSet("sendmultisig", flag.ExitOnError)
+	initiateCmd := flag.NewFlagSet("initiate", flag.ExitOnError)
+	participateCmd := flag.NewFlagSet("participate", flag.ExitOnError)
+	redeemCmd := flag.NewFlagSet("redeem", flag.ExitOnError)
+	refundCmd := flag.NewFlagSet("refund", flag.ExitOnError)
+	extractSecretCmd := flag.NewFlagSet("extractsecret", flag.ExitOnError)
+	notarizeCmd := flag.NewFlagSet("notarize", flag.ExitOnError)
+	verifyNotaryCmd := flag.NewFlagSet("verifynotary", flag.ExitOnError)
+	createPSBTCmd := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+	signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	combinePSBTCmd := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+	finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	broadcastPSBTCmd := flag.NewFlagSet("broadcastpsbt", flag.ExitOnError)
+	createRawTxCmd := flag.NewFlagSet("createrawtx", flag.ExitOnError)
+	signRawTxCmd := flag.NewFlagSet("signrawtx", flag.ExitOnError)
+	decodeRawTxCmd := flag.NewFlagSet("decoderawtx", flag.ExitOnError)
+	getTxCmd := flag.NewFlagSet("gettx", flag.ExitOnError)
+	sendRawTxCmd := flag.NewFlagSet("sendrawtx", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
-	transferFrom := transferCmd.String("from", "", "Source wallet address")
-	transferTo := transferCmd.String("to", "", "Destination wallet address")
-	transferAmount := transferCmd.Int("amount", 0, "Amount to transfer")
+	createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", false, "Maintain a transaction index")
+	sendFrom := sendCmd.String("from", "", "Source wallet address")
+	sendTo := sendCmd.String("to", "", "Destination wallet address")
+	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee per 1000 bytes of the transaction, instead of -fee")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Height or Unix time before which the payment cannot be spent")
+	sendRelativeLock := sendCmd.Int("relativelock", 0, "Blocks the payment must be mined for before it can be spent")
+	sendRelativeTime := sendCmd.Int64("relativetime", 0, "Seconds the payment must be mined for before it can be spent")
+	mineAddress := mineCmd.String("address", "", "The address to send the block rewards to")
+	mineBlocks := mineCmd.Int("blocks", 1, "Number of blocks to mine")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block")
+	getBlockHash := getBlockCmd.String("hash", "", "Hash of the block")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "Hash of the block to invalidate")
+	supplyHeight := supplyCmd.Int("height", -1, "Height to report the supply at")
+	signMessageAddress := signMessageCmd.String("address", "", "Address whose key signs the message")
+	signMessageText := signMessageCmd.String("message", "", "Message to sign")
+	verifyMessageAddress := verifyMessageCmd.String("address", "", "Address that signed the message")
+	verifyMessageSignature := verifyMessageCmd.String("signature", "", "Signature printed by signmessage")
+	verifyMessageText := verifyMessageCmd.String("message", "", "Message that was signed")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Wallet address of the key")
+	createMultiSigRequired := createMultiSigCmd.Int("required", 0, "Number of signatures required")
+	createMultiSigPubKeys := createMultiSigCmd.String("pubkeys", "", "Comma separated public keys, in hex")
+	spendMultiSigRedeem := spendMultiSigCmd.String("redeemscript", "", "Redeem script printed by createmultisig")
+	spendMultiSigTo := spendMultiSigCmd.String("to", "", "Destination address")
+	spendMultiSigAmount := spendMultiSigCmd.Int("amount", 0, "Amount to send")
+	spendMultiSigFee := spendMultiSigCmd.Int("fee", 0, "Fee paid to the miner")
+	signMultiSigTx := signMultiSigCmd.String("tx", "", "Transaction printed by spendmultisig or signmultisig")
+	signMultiSigAddress := signMultiSigCmd.String("address", "", "Wallet address whose key signs")
+	signMultiSigHash := signMultiSigCmd.String("sighash", "ALL", "Parts of the transaction signed: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	sendMultiSigTx := sendMultiSigCmd.String("tx", "", "Transaction printed by signmultisig")
+	initiateFrom := initiateCmd.String("from", "", "Wallet address funding the contract and receiving the refund")
+	initiateTo := initiateCmd.String("to", "", "Address of the participant, who redeems the contract")
+	initiateAmount := initiateCmd.Int("amount", 0, "Amount to lock in the contract")
+	initiateLockTime := initiateCmd.Int64("locktime", 0, "Height or Unix time after which the contract can be refunded")
+	initiateFee := initiateCmd.Int("fee", 0, "Fee paid to the miner")
+	participateFrom := participateCmd.String("from", "", "Wallet address funding the contract and receiving the refund")
+	participateTo := participateCmd.String("to", "", "Address of the initiator, who redeems the contract")
+	participateAmount := participateCmd.Int("amount", 0, "Amount to lock in the contract")
+	participateSecretHash := participateCmd.String("secrethash", "", "Secret hash printed by initiate")
+	participateLockTime := participateCmd.Int64("locktime", 0, "Height or Unix time after which the contract can be refunded")
+	participateFee := participateCmd.Int("fee", 0, "Fee paid to the miner")
+	redeemContract := redeemCmd.String("contract", "", "Contract printed by initiate or participate")
+	redeemContractTx := redeemCmd.String("contracttx", "", "ID of the transaction funding the contract")
+	redeemSecret := redeemCmd.String("secret", "", "Secret of the contract")
+	redeemAddress := redeemCmd.String("address", "", "Wallet address the contract pays")
+	redeemFee := redeemCmd.Int("fee", 0, "Fee paid to the miner")
+	refundContract := refundCmd.String("contract", "", "Contract printed by initiate or participate")
+	refundContractTx := refundCmd.String("contracttx", "", "ID of the transaction funding the contract")
+	refundAddress := refundCmd.String("address", "", "Wallet address that funded the contract")
+	refundFee := refundCmd.Int("fee", 0, "Fee paid to the miner")
+	extractSecretTx := extractSecretCmd.String("tx", "", "ID of the transaction redeeming the contract")
+	extractSecretHash := extractSecretCmd.String("secrethash", "", "Secret hash of the contract")
+	notarizeFile := notarizeCmd.String("file", "", "File to notarize")
+	notarizeAddress := notarizeCmd.String("address", "", "Wallet address paying the fee")
+	notarizeFee := notarizeCmd.Int("fee", 0, "Fee paid to the miner")
+	verifyNotaryFile := verifyNotaryCmd.String("file", "", "File to look up")
+	createPSBTFrom := createPSBTCmd.String("from", "", "Key address paying")
+	createPSBTRedeem := createPSBTCmd.String("redeemscript", "", "Redeem script of the multisig address paying, instead of -from")
+	createPSBTTo := createPSBTCmd.String("to", "", "Destination address")
+	createPSBTAmount := createPSBTCmd.Int("amount", 0, "Amount to send")
+	createPSBTFee := createPSBTCmd.Int("fee", 0, "Fee paid to the miner")
+	signPSBT := signPSBTCmd.String("psbt", "", "Partial transaction to sign")
+	signPSBTHash := signPSBTCmd.String("sighash", "ALL", "Parts of the transaction signed: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	combinePSBTs := combinePSBTCmd.String("psbts", "", "Comma separated copies of a partial transaction")
+	finalizePSBT := finalizePSBTCmd.String("psbt", "", "Fully signed partial transaction")
+	broadcastPSBT := broadcastPSBTCmd.String("psbt", "", "Fully signed partial transaction")
+	createRawTxInputs := createRawTxCmd.String("inputs", "", `Inputs as JSON: [{"txid":TXID,"vout":N,"sequence":N}]`)
+	createRawTxOutputs := createRawTxCmd.String("outputs", "", `Outputs as JSON: [{"address":ADDRESS,"amount":N}] or [{"data":HEX}]`)
+	createRawTxLockTime := createRawTxCmd.Int64("locktime", 0, "Height or Unix time before which the transaction can not be mined")
+	signRawTx := signRawTxCmd.String("tx", "", "Raw transaction to sign")
+	signRawTxAddress := signRawTxCmd.String("address", "", "Wallet address whose key signs")
+	signRawTxHash := signRawTxCmd.String("sighash", "ALL", "Parts of the transaction signed: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	decodeRawTx := decodeRawTxCmd.String("tx", "", "Raw transaction to decode")
+	getTxID := getTxCmd.String("id", "", "Transaction ID")
+	sendRawTx := sendRawTxCmd.String("tx", "", "Signed raw transaction")
+
+	var network, dataDir string
+	for _, cmd := range []*flag.FlagSet{getBalanceCmd, createBlockchainCmd, sendCmd, mineCmd, chainDataCmd, getBlockCmd, createWalletCmd, addressesCmd, reindexUTXOCmd, reindexTxCmd, invalidateBlockCmd, supplyCmd, signMessageCmd, verifyMessageCmd, getPubKeyCmd, createMultiSigCmd, spendMultiSigCmd, signMultiSigCmd, sendMultiSigCmd, initiateCmd, participateCmd, redeemCmd, refundCmd, extractSecretCmd, notarizeCmd, verifyNotaryCmd, createPSBTCmd, signPSBTCmd, combinePSBTCmd, finalizePSBTCmd, broadcastPSBTCmd, createRawTxCmd, signRawTxCmd, decodeRawTxCmd, getTxCmd, sendRawTxCmd} {
+		cmd.StringVar(&network, "network", chaincfg.MainNetParams.Name, "Network to use: mainnet, testnet or regtest")
+		cmd.StringVar(&dataDir, "datadir", "", "Directory for the blockchain database and wallets")
+	}
+
+	parse := func(cmd *flag.FlagSet) error {
+		cmd.Parse(args)
 
-	switch os.Args[1] {
+		params, err := chaincfg.ParamsForNetwork(network)
+		if err != nil {
+			return err
+		}
+		if dataDir != "" {
+			params.DataDir = dataDir
+		}
+		cli.params = params
+
+		return nil
+	}
+
+	switch command {
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		HandleErr(err)
+		if err := parse(getBalanceCmd); err != nil {
+			return err
+		}
+		if *getBalanceAddress == "" {
+			getBalanceCmd.Usage()
+			return errUsage
+		}
+		return cli.getBalance(*getBalanceAddress)
 
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
-		HandleErr(err)
+		if err := parse(createBlockchainCmd); err != nil {
+			return err
+		}
+		if *createBlockchainAddress == "" {
+			createBlockchainCmd.Usage()
+			return errUsage
+		}
+		return cli.createBlockchain(*createBlockchainAddress, *createBlockchainTxIndex)
+
+	case "send":
+		if err := parse(sendCmd); err != nil {
+			return err
+		}
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendFeeRate < 0 ||
+			(*sendRelativeLock != 0 && *sendRelativeTime != 0) {
+			sendCmd.Usage()
+			return errUsage
+		}
+		lock := blockchain.PaymentLock{LockTime: *sendLockTime}
+		var err error
+		switch {
+		case *sendRelativeLock != 0:
+			lock.Sequence, err = blockchain.RelativeLockBlocks(*sendRelativeLock)
+		case *sendRelativeTime != 0:
+			lock.Sequence, err = blockchain.RelativeLockSeconds(*sendRelativeTime)
+		}
+		if err != nil {
+			return err
+		}
+		return cli.send(*sendFrom, *sendTo, *sendAmount, blockchain.Fee{Amount: *sendFee, Rate: *sendFeeRate}, lock)
 
-	case "transfer":
-		err := transferCmd.Parse(os.Args[2:])
-		HandleErr(err)
+	case "mine":
+		if err := parse(mineCmd); err != nil {
+			return err
+		}
+		if *mineAddress == "" || *mineBlocks <= 0 {
+			mineCmd.Usage()
+			return errUsage
+		}
+		return cli.mine(*mineAddress, *mineBlocks)
 
 	case "chaindata":
-		err := chainDataCmd.Parse(os.Args[2:])
-		HandleErr(err)
+		if err := parse(chainDataCmd); err != nil {
+			return err
+		}
+		return cli.printBlockchain()
+
+	case "getblock":
+		if err := parse(getBlockCmd); err != nil {
+			return err
+		}
+		if *getBlockHeight < 0 && *getBlockHash == "" {
+			getBlockCmd.Usage()
+			return errUsage
+		}
+		return cli.getBlock(*getBlockHeight, *getBlockHash)
 
 	case "addresses":
-		err := addressesCmd.Parse(os.Args[2:])
-		HandleErr(err)
+		if err := parse(addressesCmd); err != nil {
+			return err
+		}
+		return cli.listAddresses()
 
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
-		HandleErr(err)
+		if err := parse(createWalletCmd); err != nil {
+			return err
+		}
+		return cli.createWallet()
 
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
-		HandleErr(err)
+		if err := parse(reindexUTXOCmd); err != nil {
+			return err
+		}
+		return cli.reindexUTXO()
 
-	default:
-		cli.printUsage()
-		runtime.Goexit()
-	}
+	case "reindextx":
+		if err := parse(reindexTxCmd); err != nil {
+			return err
+		}
+		return cli.reindexTransactions()
 
-	if getBalanceCmd.Parsed() {
-		if *getBalanceAddress == "" {
-			getBalanceCmd.Usage()
-			runtime.Goexit()
+	case "invalidateblock":
+		if err := parse(invalidateBlockCmd); err != nil {
+			return err
 		}
-		cli.getBalance(*getBalanceAddress)
-	}
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			return errUsage
+		}
+		return cli.invalidateBlock(*invalidateBlockHash)
 
-	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
-			runtime.Goexit()
+	case "supply":
+		if err := parse(supplyCmd); err != nil {
+			return err
 		}
-		cli.createBlockchain(*createBlockchainAddress)
-	}
+		return cli.supply(*supplyHeight)
 
-	if transferCmd.Parsed() {
-		if *transferFrom == "" || *transferTo == "" || *transferAmount == 0 {
-			transferCmd.Usage()
-			runtime.Goexit()
+	case "signmessage":
+		if err := parse(signMessageCmd); err != nil {
+			return err
 		}
-		cli.transfer(*transferFrom, *transferTo, *transferAmount)
-	}
+		if *signMessageAddress == "" {
+			signMessageCmd.Usage()
+			return errUsage
+		}
+		return cli.signMessage(*signMessageAddress, *signMessageText)
 
-	if chainDataCmd.Parsed() {
-		cli.printBlockchain()
-	}
+	case "verifymessage":
+		if err := parse(verifyMessageCmd); err != nil {
+			return err
+		}
+		if *verifyMessageAddress == "" || *verifyMessageSignature == "" {
+			verifyMessageCmd.Usage()
+			return errUsage
+		}
+		return cli.verifyMessage(*verifyMessageAddress, *verifyMessageSignature, *verifyMessageText)
 
-	if addressesCmd.Parsed() {
-		cli.listAddresses()
-	}
+	case "getpubkey":
+		if err := parse(getPubKeyCmd); err != nil {
+			return err
+		}
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			return errUsage
+		}
+		return cli.getPubKey(*getPubKeyAddress)
 
-	if createWalletCmd.Parsed() {
-		cli.createWallet()
-	}
+	case "createmultisig":
+		if err := parse(createMultiSigCmd); err != nil {
+			return err
+		}
+		if *createMultiSigRequired <= 0 || *createMultiSigPubKeys == "" {
+			createMultiSigCmd.Usage()
+			return errUsage
+		}
+		return cli.createMultiSig(*createMultiSigRequired, *createMultiSigPubKeys)
 
-	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO()
-	}
+	case "spendmultisig":
+		if err := parse(spendMultiSigCmd); err != nil {
+			return err
+		}
+		if *spendMultiSigRedeem == "" || *spendMultiSigTo == "" || *spendMultiSigAmount <= 0 || *spendMultiSigFee < 0 {
+			spendMultiSigCmd.Usage()
+			return errUsage
+		}
+		return cli.spendMultiSig(*spendMultiSigRedeem, *spendMultiSigTo, *spendMultiSigAmount, *spendMultiSigFee)
+
+	case "signmultisig":
+		if err := parse(signMultiSigCmd); err != nil {
+			return err
+		}
+		if *signMultiSigTx == "" || *signMultiSigAddress == "" {
+			signMultiSigCmd.Usage()
+			return errUsage
+		}
+		return cli.signMultiSig(*signMultiSigTx, *signMultiSigAddress, *signMultiSigHash)
+
+	case "sendmultisig":
+		if err := parse(sendMultiSigCmd); err != nil {
+			return err
+		}
+		if *sendMultiSigTx == "" {
+			sendMultiSigCmd.Usage()
+			return errUsage
+		}
+		return cli.sendRawTx(*sendMultiSigTx)
+
+	case "initiate":
+		if err := parse(initiateCmd); err != nil {
+			return err
+		}
+		if *initiateFrom == "" || *initiateTo == "" || *initiateAmount <= 0 || *initiateFee < 0 || *initiateLockTime < 0 {
+			initiateCmd.Usage()
+			return errUsage
+		}
+		return cli.initiate(*initiateFrom, *initiateTo, *initiateAmount, *initiateFee, *initiateLockTime)
+
+	case "participate":
+		if err := parse(participateCmd); err != nil {
+			return err
+		}
+		if *participateFrom == "" || *participateTo == "" || *participateAmount <= 0 || *participateSecretHash == "" ||
+			*participateFee < 0 || *participateLockTime < 0 {
+			participateCmd.Usage()
+			return errUsage
+		}
+		return cli.participate(*participateFrom, *participateTo, *participateAmount, *participateFee, *participateSecretHash, *participateLockTime)
+
+	case "redeem":
+		if err := parse(redeemCmd); err != nil {
+			return err
+		}
+		if *redeemContract == "" || *redeemContractTx == "" || *redeemSecret == "" || *redeemAddress == "" || *redeemFee < 0 {
+			redeemCmd.Usage()
+			return errUsage
+		}
+		return cli.redeem(*redeemContract, *redeemContractTx, *redeemSecret, *redeemAddress, *redeemFee)
+
+	case "refund":
+		if err := parse(refundCmd); err != nil {
+			return err
+		}
+		if *refundContract == "" || *refundContractTx == "" || *refundAddress == "" || *refundFee < 0 {
+			refundCmd.Usage()
+			return errUsage
+		}
+		return cli.refund(*refundContract, *refundContractTx, *refundAddress, *refundFee)
+
+	case "extractsecret":
+		if err := parse(extractSecretCmd); err != nil {
+			return err
+		}
+		if *extractSecretTx == "" || *extractSecretHash == "" {
+			extractSecretCmd.Usage()
+			return errUsage
+		}
+		return cli.extractSecret(*extractSecretTx, *extractSecretHash)
+
+	case "notarize":
+		if err := parse(notarizeCmd); err != nil {
+			return err
+		}
+		if *notarizeFile == "" || *notarizeAddress == "" || *notarizeFee < 0 {
+			notarizeCmd.Usage()
+			return errUsage
+		}
+		return cli.notarize(*notarizeFile, *notarizeAddress, *notarizeFee)
+
+	case "verifynotary":
+		if err := parse(verifyNotaryCmd); err != nil {
+			return err
+		}
+		if *verifyNotaryFile == "" {
+			verifyNotaryCmd.Usage()
+			return errUsage
+		}
+		return cli.verifyNotary(*verifyNotaryFile)
+
+	case "createpsbt":
+		if err := parse(createPSBTCmd); err != nil {
+			return err
+		}
+		if (*createPSBTFrom == "") == (*createPSBTRedeem == "") || *createPSBTTo == "" || *createPSBTAmount <= 0 || *createPSBTFee < 0 {
+			createPSBTCmd.Usage()
+			return errUsage
+		}
+		return cli.createPSBT(*createPSBTFrom, *createPSBTRedeem, *createPSBTTo, *createPSBTAmount, *createPSBTFee)
+
+	case "signpsbt":
+		if err := parse(signPSBTCmd); err != nil {
+			return err
+		}
+		if *signPSBT == "" {
+			signPSBTCmd.Usage()
+			return errUsage
+		}
+		return cli.signPSBT(*signPSBT, *signPSBTHash)
+
+	case "combinepsbt":
+		if err := parse(combinePSBTCmd); err != nil {
+			return err
+		}
+		if *combinePSBTs == "" {
+			combinePSBTCmd.Usage()
+			return errUsage
+		}
+		return cli.combinePSBT(*combinePSBTs)
+
+	case "finalizepsbt":
+		if err := parse(finalizePSBTCmd); err != nil {
+			return err
+		}
+		if *finalizePSBT == "" {
+			finalizePSBTCmd.Usage()
+			return errUsage
+		}
+		return cli.finalizePSBT(*finalizePSBT)
+
+	case "broadcastpsbt":
+		if err := parse(broadcastPSBTCmd); err != nil {
+			return err
+		}
+		if *broadcastPSBT == "" {
+			broadcastPSBTCmd.Usage()
+			return errUsage
+		}
+		return cli.broadcastPSBT(*broadcastPSBT)
+
+	case "createrawtx":
+		if err := parse(createRawTxCmd); err != nil {
+			return err
+		}
+		if *createRawTxInputs == "" || *createRawTxOutputs == "" || *createRawTxLockTime < 0 {
+			createRawTxCmd.Usage()
+			return errUsage
+		}
+		return cli.createRawTx(*createRawTxInputs, *createRawTxOutputs, *createRawTxLockTime)
+
+	case "signrawtx":
+		if err := parse(signRawTxCmd); err != nil {
+			return err
+		}
+		if *signRawTx == "" || *signRawTxAddress == "" {
+			signRawTxCmd.Usage()
+			return errUsage
+		}
+		return cli.signRawTx(*signRawTx, *signRawTxAddress, *signRawTxHash)
+
+	case "decoderawtx":
+		if err := parse(decodeRawTxCmd); err != nil {
+			return err
+		}
+		if *decodeRawTx == "" {
+			decodeRawTxCmd.Usage()
+			return errUsage
+		}
+		return cli.decodeRawTx(*decodeRawTx)
+
+	case "gettx":
+		if err := parse(getTxCmd); err != nil {
+			return err
+		}
+		if *getTxID == "" {
+			getTxCmd.Usage()
+			return errUsage
+		}
+		return cli.getTx(*getTxID)
+
+	case "sendrawtx":
+		if err := parse(sendRawTxCmd); err != nil {
+			return err
+		}
+		if *sendRawTx == "" {
+			sendRawTxCmd.Usage()
+			return errUsage
+		}
+		return cli.sendRawTx(*sendRawTx)
 
+	default:
+		cli.printUsage()
+		return errUsage
+	}
 }
@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/blockchain"
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+func TestInvalidateBlockRestoresMempool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	params := chaincfg.RegTestParams
+	params.DataDir = dir
+
+	// Mine a payment queued in the pool, as send and mine do
+	w := wallet.CreateWallet()
+	address := string(w.Address(params.AddressVersion))
+	chain, err := blockchain.InitBlockchain(address, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	tx, err := pool.NewTransaction(w, string(wallet.CreateWallet().Address(params.AddressVersion)), 20, blockchain.Fee{}, blockchain.PaymentLock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	block, err := pool.MineBlock(context.Background(), address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+	chain.Database.Close()
+
+	cli := CommandLine{params: &params}
+	if err := cli.invalidateBlock(hex.EncodeToString(block.Hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err = blockchain.ContinueBlockchain(&params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+	pool = blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !pool.HasTransaction(tx.ID) {
+		t.Errorf("transaction %x of the invalidated block is not back in the mempool", tx.ID)
+	}
+}
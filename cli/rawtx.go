@@ -0,0 +1,308 @@
+package cli
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bahadylbekov/go-blockchain/blockchain"
+	"github.com/bahadylbekov/go-blockchain/script"
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// rawInput and rawOutput are the JSON forms createrawtx takes. An output
+// pays Amount to Address or, with Data set, carries hex encoded data.
+type rawInput struct {
+	TxID     string `json:"txid"`
+	Vout     int    `json:"vout"`
+	Sequence uint32 `json:"sequence"`
+}
+
+type rawOutput struct {
+	Address string `json:"address,omitempty"`
+	Amount  int    `json:"amount"`
+	Data    string `json:"data,omitempty"`
+}
+
+// txView is the JSON form decoderawtx and gettx print. Hash is the witness
+// hash, which unlike the ID covers the unlocking scripts.
+type txView struct {
+	TxID     string       `json:"txid"`
+	Hash     string       `json:"hash"`
+	Size     int          `json:"size"`
+	LockTime int64        `json:"locktime"`
+	Inputs   []inputView  `json:"inputs"`
+	Outputs  []outputView `json:"outputs"`
+}
+
+type inputView struct {
+	TxID     string `json:"txid,omitempty"`
+	Vout     int    `json:"vout"`
+	Sequence uint32 `json:"sequence"`
+	Script   string `json:"script,omitempty"`
+	Coinbase string `json:"coinbase,omitempty"`
+}
+
+type outputView struct {
+	Value   int    `json:"value"`
+	Type    string `json:"type"`
+	Address string `json:"address,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Script  string `json:"script"`
+	Hex     string `json:"hex"`
+}
+
+// txInfoView is txView with where the transaction is, for gettx. Block is
+// nil for transactions still in the pool.
+type txInfoView struct {
+	txView
+	Block         *blockRefView `json:"block,omitempty"`
+	Confirmations int           `json:"confirmations"`
+}
+
+type blockRefView struct {
+	Hash      string `json:"hash"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// scriptAddress returns the address a locking script pays to, or "" if it
+// pays to no single address
+func (cli *CommandLine) scriptAddress(lockingScript []byte) string {
+	if hash := script.ExtractPubKeyHash(lockingScript); hash != nil {
+		return string(wallet.EncodeAddress(hash, cli.params.AddressVersion))
+	}
+	if hash := script.ExtractScriptHash(lockingScript); hash != nil {
+		return string(wallet.EncodeAddress(hash, cli.params.ScriptAddressVersion))
+	}
+	if _, hash, ok := script.ExtractTimeLock(lockingScript); ok {
+		return string(wallet.EncodeAddress(hash, cli.params.AddressVersion))
+	}
+	if _, hash, ok := script.ExtractSequenceLock(lockingScript); ok {
+		return string(wallet.EncodeAddress(hash, cli.params.AddressVersion))
+	}
+
+	return ""
+}
+
+func (cli *CommandLine) newTxView(tx *blockchain.Transaction) txView {
+	view := txView{
+		TxID:     hex.EncodeToString(tx.ID),
+		Hash:     hex.EncodeToString(tx.WitnessHash()),
+		Size:     len(tx.Serialize()),
+		LockTime: tx.LockTime,
+		Inputs:   []inputView{},
+		Outputs:  []outputView{},
+	}
+
+	for _, in := range tx.Inputs {
+		input := inputView{TxID: hex.EncodeToString(in.ID), Vout: in.Out, Sequence: in.Sequence}
+		if tx.IsCoinBase() {
+			input.Coinbase = hex.EncodeToString(in.UnlockingScript)
+		} else {
+			input.Script = script.DisassembleString(in.UnlockingScript)
+		}
+		view.Inputs = append(view.Inputs, input)
+	}
+
+	for _, out := range tx.Outputs {
+		output := outputView{
+			Value:   out.Value,
+			Type:    script.Classify(out.LockingScript).String(),
+			Address: cli.scriptAddress(out.LockingScript),
+			Script:  script.DisassembleString(out.LockingScript),
+			Hex:     hex.EncodeToString(out.LockingScript),
+		}
+		if data, ok := script.ExtractNullData(out.LockingScript); ok {
+			output.Data = hex.EncodeToString(data)
+		}
+		view.Outputs = append(view.Outputs, output)
+	}
+
+	return view
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+// createRawTx prints an unsigned transaction spending the inputs and making
+// the outputs given in JSON
+func (cli *CommandLine) createRawTx(inputsJSON, outputsJSON string, lockTime int64) error {
+	var inputs []rawInput
+	if err := json.Unmarshal([]byte(inputsJSON), &inputs); err != nil {
+		return fmt.Errorf("parsing inputs: %w", err)
+	}
+	var outputs []rawOutput
+	if err := json.Unmarshal([]byte(outputsJSON), &outputs); err != nil {
+		return fmt.Errorf("parsing outputs: %w", err)
+	}
+	if len(inputs) == 0 || len(outputs) == 0 {
+		return errors.New("a transaction needs inputs and outputs")
+	}
+
+	tx := blockchain.Transaction{LockTime: lockTime}
+	for _, in := range inputs {
+		txID, err := hex.DecodeString(in.TxID)
+		if err != nil {
+			return err
+		}
+		if in.Vout < 0 {
+			return fmt.Errorf("invalid output index %d", in.Vout)
+		}
+		tx.Inputs = append(tx.Inputs, blockchain.TxInput{ID: txID, Out: in.Vout, Sequence: in.Sequence})
+	}
+
+	for _, out := range outputs {
+		if out.Amount < 0 {
+			return fmt.Errorf("invalid amount %d", out.Amount)
+		}
+
+		switch {
+		case out.Data != "" && out.Address == "":
+			data, err := hex.DecodeString(out.Data)
+			if err != nil {
+				return err
+			}
+			output, err := blockchain.NewDataOutput(data)
+			if err != nil {
+				return err
+			}
+			output.Value = out.Amount
+			tx.Outputs = append(tx.Outputs, *output)
+		case out.Address != "" && out.Data == "":
+			if !cli.validPayee(out.Address) {
+				return errInvalidAddress
+			}
+			output, err := blockchain.NewTxOutput(out.Amount, out.Address, cli.params)
+			if err != nil {
+				return err
+			}
+			tx.Outputs = append(tx.Outputs, *output)
+		default:
+			return errors.New("every output needs either an address or data")
+		}
+	}
+	tx.ID = tx.Hash()
+
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+	return nil
+}
+
+// signRawTx adds the signatures of address to the inputs of a raw
+// transaction it can sign
+func (cli *CommandLine) signRawTx(txHex, address, sigHash string) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errInvalidAddress
+	}
+	hashType, err := blockchain.ParseSigHashType(sigHash)
+	if err != nil {
+		return err
+	}
+
+	tx, err := decodeTransaction(txHex)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.params)
+	if err != nil {
+		return err
+	}
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+	if err := pool.LoadFile(); err != nil {
+		return err
+	}
+
+	signed, err := chain.SignRawTransaction(tx, w.PrivateKey, hashType)
+	if err != nil {
+		return err
+	}
+	complete, err := chain.VerifyTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Signed %d of %d inputs\n", signed, len(tx.Inputs))
+	fmt.Printf("Complete: %t\n", complete)
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+	return nil
+}
+
+func (cli *CommandLine) decodeRawTx(txHex string) error {
+	tx, err := decodeTransaction(txHex)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(cli.newTxView(tx))
+}
+
+// getTx prints a transaction of the chain or the pool, with the block holding
+// it and its confirmations
+func (cli *CommandLine) getTx(txID string) error {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockchain(cli.params)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	tx, block, err := chain.FindTransactionBlock(id)
+	if errors.Is(err, blockchain.ErrTxNotFound) {
+		pool := blockchain.NewMempool(chain, blockchain.DefaultMaxMempoolSize)
+		if err := pool.LoadFile(); err != nil {
+			return err
+		}
+		pending, ok := pool.Transaction(id)
+		if !ok {
+			return err
+		}
+		return printJSON(txInfoView{txView: cli.newTxView(pending)})
+	} else if err != nil {
+		return err
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	return printJSON(txInfoView{
+		txView:        cli.newTxView(tx),
+		Block:         &blockRefView{hex.EncodeToString(block.Hash), block.Height, block.Timestamp},
+		Confirmations: height - block.Height + 1,
+	})
+}
+
+// sendRawTx queues a fully signed transaction
+func (cli *CommandLine) sendRawTx(txHex string) error {
+	tx, err := decodeTransaction(txHex)
+	if err != nil {
+		return err
+	}
+
+	return cli.queueTransaction(tx)
+}
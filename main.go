@@ -7,10 +7,8 @@ import (
 )
 
 func main() {
-	defer os.Exit(0)
-
 	cli := cli.CommandLine{}
-	cli.Run()
+	os.Exit(cli.Run())
 
 	// w := wallet.CreateWallet()
 	// w.Address()
@@ -0,0 +1,186 @@
+package script
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// instruction is one parsed opcode with the data it pushes, if any
+type instruction struct {
+	op   byte
+	data []byte
+}
+
+// pushed returns the value a push instruction places on the stack
+func (ins instruction) pushed() []byte {
+	switch {
+	case ins.op == OP_1NEGATE:
+		return numBytes(-1)
+	case ins.op >= OP_1 && ins.op <= OP_16:
+		return numBytes(int64(ins.op - OP_1 + 1))
+	}
+
+	return ins.data
+}
+
+// parse splits a script into instructions
+func parse(script []byte) ([]instruction, error) {
+	var instructions []instruction
+
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+
+		var size int
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			size = int(op)
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, scriptError("truncated OP_PUSHDATA1")
+			}
+			size = int(script[i])
+			i++
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, scriptError("truncated OP_PUSHDATA2")
+			}
+			size = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+
+		if i+size > len(script) {
+			return nil, scriptError("push of %d bytes runs past the end of the script", size)
+		}
+		instructions = append(instructions, instruction{op, script[i : i+size]})
+		i += size
+	}
+
+	return instructions, nil
+}
+
+// Builder assembles a script from opcodes and data pushes
+type Builder struct {
+	script []byte
+}
+
+// NewBuilder returns an empty script builder
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// AddOp appends an opcode
+func (b *Builder) AddOp(op byte) *Builder {
+	b.script = append(b.script, op)
+
+	return b
+}
+
+// AddData appends the smallest push of data
+func (b *Builder) AddData(data []byte) *Builder {
+	switch n := len(data); {
+	case n == 0:
+		b.script = append(b.script, OP_0)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	}
+	b.script = append(b.script, data...)
+
+	return b
+}
+
+// AddInt64 appends a push of n, using OP_0 to OP_16 when possible
+func (b *Builder) AddInt64(n int64) *Builder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 - 1 + n))
+	}
+
+	return b.AddData(numBytes(n))
+}
+
+// Script returns the assembled script
+func (b *Builder) Script() []byte {
+	return append([]byte{}, b.script...)
+}
+
+// Disassemble returns a human readable form of script, with data pushes in hex
+func Disassemble(script []byte) (string, error) {
+	instructions, err := parse(script)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, 0, len(instructions))
+	for _, ins := range instructions {
+		switch {
+		case ins.op > OP_0 && ins.op <= OP_PUSHDATA2:
+			parts = append(parts, hex.EncodeToString(ins.data))
+		case ins.op >= OP_1 && ins.op <= OP_16:
+			parts = append(parts, "OP_"+strconv.Itoa(int(ins.op-OP_1+1)))
+		default:
+			name, ok := opcodeNames[ins.op]
+			if !ok {
+				name = "OP_UNKNOWN_" + hex.EncodeToString([]byte{ins.op})
+			}
+			parts = append(parts, name)
+		}
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// DisassembleString returns the readable form of script, or its hex encoding
+// marked invalid if it does not parse
+func DisassembleString(script []byte) string {
+	text, err := Disassemble(script)
+	if err != nil {
+		return "[invalid] " + hex.EncodeToString(script)
+	}
+
+	return text
+}
+
+// IsPushOnly reports whether script consists of data pushes only
+func IsPushOnly(script []byte) bool {
+	instructions, err := parse(script)
+	if err != nil {
+		return false
+	}
+
+	for _, ins := range instructions {
+		if !isPush(ins.op) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PushedData returns the data pushed by a push-only script
+func PushedData(script []byte) ([][]byte, error) {
+	instructions, err := parse(script)
+	if err != nil {
+		return nil, err
+	}
+
+	var data [][]byte
+	for _, ins := range instructions {
+		if !isPush(ins.op) {
+			return nil, scriptError("script is not push only")
+		}
+		data = append(data, ins.pushed())
+	}
+
+	return data, nil
+}
@@ -0,0 +1,471 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// Resource limits enforced while a script runs
+const (
+	MaxScriptSize         = 10000
+	MaxElementSize        = 520
+	MaxStackSize          = 1000
+	MaxOpsPerScript       = 201
+	MaxPubKeysPerMultiSig = 20
+
+	// maxNumberSize is the longest number operand, in bytes
+	maxNumberSize = 4
+	// maxLockTimeSize is the longest lock time or sequence operand, in bytes
+	maxLockTimeSize = 5
+)
+
+// ErrScriptFailed is wrapped by every error returned when a script does not
+// run or does not leave a true value on the stack
+var ErrScriptFailed = errors.New("script failed")
+
+func scriptError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrScriptFailed, fmt.Sprintf(format, a...))
+}
+
+// SigChecker gives the interpreter access to the spending transaction
+type SigChecker interface {
+	// CheckSig reports whether sig is a valid signature by pubKey of the
+	// spending transaction, where subScript is the script being executed
+	CheckSig(sig, pubKey, subScript []byte) bool
+	// CheckLockTime reports whether the spending transaction is locked until
+	// at least lockTime
+	CheckLockTime(lockTime int64) bool
+	// CheckSequence reports whether the input being verified is locked
+	// relative to the output it spends for at least sequence
+	CheckSequence(sequence int64) bool
+}
+
+// Verify runs the unlocking script of an input followed by the locking script
+// of the output it spends. If the locking script is pay-to-script-hash, the
+// last item pushed by the unlocking script is run as the redeem script with
+// the items before it on the stack.
+func Verify(unlocking, locking []byte, checker SigChecker) error {
+	if !IsPushOnly(unlocking) {
+		return scriptError("unlocking script must only push data")
+	}
+
+	stack, err := execute(unlocking, nil, checker)
+	if err != nil {
+		return err
+	}
+	unlocked := append([][]byte{}, stack...)
+
+	if stack, err = execute(locking, stack, checker); err != nil {
+		return err
+	}
+	if err := checkResult(stack); err != nil {
+		return err
+	}
+
+	if !IsPayToScriptHash(locking) {
+		return nil
+	}
+	if len(unlocked) == 0 {
+		return scriptError("missing redeem script")
+	}
+
+	redeem := unlocked[len(unlocked)-1]
+	if stack, err = execute(redeem, unlocked[:len(unlocked)-1], checker); err != nil {
+		return err
+	}
+
+	return checkResult(stack)
+}
+
+func checkResult(stack [][]byte) error {
+	if len(stack) == 0 || !asBool(stack[len(stack)-1]) {
+		return scriptError("script evaluated to false")
+	}
+
+	return nil
+}
+
+// execute runs script on top of stack and returns the resulting stack
+func execute(script []byte, stack [][]byte, checker SigChecker) ([][]byte, error) {
+	if len(script) > MaxScriptSize {
+		return nil, scriptError("script is %d bytes, more than %d", len(script), MaxScriptSize)
+	}
+
+	instructions, err := parse(script)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stackMachine{stack: stack}
+	var conditions []bool
+	ops := 0
+
+	for _, ins := range instructions {
+		if len(ins.data) > MaxElementSize {
+			return nil, scriptError("push of %d bytes is larger than %d", len(ins.data), MaxElementSize)
+		}
+		if !isPush(ins.op) {
+			if ops++; ops > MaxOpsPerScript {
+				return nil, scriptError("more than %d operations", MaxOpsPerScript)
+			}
+		}
+
+		executing := true
+		for _, c := range conditions {
+			executing = executing && c
+		}
+
+		switch ins.op {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if executing {
+				top, err := s.pop()
+				if err != nil {
+					return nil, err
+				}
+				branch = asBool(top) == (ins.op == OP_IF)
+			}
+			conditions = append(conditions, branch)
+			continue
+		case OP_ELSE:
+			if len(conditions) == 0 {
+				return nil, scriptError("OP_ELSE without OP_IF")
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OP_ENDIF:
+			if len(conditions) == 0 {
+				return nil, scriptError("OP_ENDIF without OP_IF")
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+
+		if !executing {
+			continue
+		}
+		if err := s.step(ins, script, checker); err != nil {
+			return nil, err
+		}
+		if len(s.stack) > MaxStackSize {
+			return nil, scriptError("stack holds more than %d items", MaxStackSize)
+		}
+	}
+
+	if len(conditions) != 0 {
+		return nil, scriptError("unbalanced conditional")
+	}
+
+	return s.stack, nil
+}
+
+type stackMachine struct {
+	stack [][]byte
+}
+
+func (s *stackMachine) push(item []byte) {
+	s.stack = append(s.stack, item)
+}
+
+func (s *stackMachine) pop() ([]byte, error) {
+	if len(s.stack) == 0 {
+		return nil, scriptError("stack is empty")
+	}
+	item := s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+
+	return item, nil
+}
+
+func (s *stackMachine) popNumber(maxSize int) (int64, error) {
+	item, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return asNumber(item, maxSize)
+}
+
+func (s *stackMachine) peek() ([]byte, error) {
+	if len(s.stack) == 0 {
+		return nil, scriptError("stack is empty")
+	}
+
+	return s.stack[len(s.stack)-1], nil
+}
+
+// step executes one instruction outside of flow control
+func (s *stackMachine) step(ins instruction, script []byte, checker SigChecker) error {
+	switch op := ins.op; {
+	case isPush(op):
+		s.push(ins.pushed())
+
+	case op == OP_NOP:
+
+	case op == OP_VERIFY:
+		top, err := s.pop()
+		if err != nil {
+			return err
+		}
+		if !asBool(top) {
+			return scriptError("OP_VERIFY failed")
+		}
+
+	case op == OP_RETURN:
+		return scriptError("OP_RETURN executed")
+
+	case op == OP_DROP:
+		_, err := s.pop()
+		return err
+
+	case op == OP_DUP:
+		top, err := s.peek()
+		if err != nil {
+			return err
+		}
+		s.push(top)
+
+	case op == OP_SWAP:
+		a, err := s.pop()
+		if err != nil {
+			return err
+		}
+		b, err := s.pop()
+		if err != nil {
+			return err
+		}
+		s.push(a)
+		s.push(b)
+
+	case op == OP_SIZE:
+		top, err := s.peek()
+		if err != nil {
+			return err
+		}
+		s.push(numBytes(int64(len(top))))
+
+	case op == OP_EQUAL, op == OP_EQUALVERIFY:
+		a, err := s.pop()
+		if err != nil {
+			return err
+		}
+		b, err := s.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op == OP_EQUALVERIFY {
+			if !equal {
+				return scriptError("OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		s.push(fromBool(equal))
+
+	case op == OP_SHA256:
+		top, err := s.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		s.push(hash[:])
+
+	case op == OP_HASH160:
+		top, err := s.pop()
+		if err != nil {
+			return err
+		}
+		s.push(wallet.PublicKeyHash(top))
+
+	case op == OP_CHECKSIG, op == OP_CHECKSIGVERIFY:
+		pubKey, err := s.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := s.pop()
+		if err != nil {
+			return err
+		}
+		valid := checker.CheckSig(sig, pubKey, script)
+		if op == OP_CHECKSIGVERIFY {
+			if !valid {
+				return scriptError("OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		s.push(fromBool(valid))
+
+	case op == OP_CHECKMULTISIG, op == OP_CHECKMULTISIGVERIFY:
+		valid, err := s.checkMultiSig(script, checker)
+		if err != nil {
+			return err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return scriptError("OP_CHECKMULTISIGVERIFY failed")
+			}
+			return nil
+		}
+		s.push(fromBool(valid))
+
+	case op == OP_CHECKLOCKTIMEVERIFY:
+		top, err := s.peek()
+		if err != nil {
+			return err
+		}
+		lockTime, err := asNumber(top, maxLockTimeSize)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 {
+			return scriptError("negative lock time")
+		}
+		if !checker.CheckLockTime(lockTime) {
+			return scriptError("lock time %d has not been reached", lockTime)
+		}
+
+	case op == OP_CHECKSEQUENCEVERIFY:
+		top, err := s.peek()
+		if err != nil {
+			return err
+		}
+		sequence, err := asNumber(top, maxLockTimeSize)
+		if err != nil {
+			return err
+		}
+		if sequence < 0 {
+			return scriptError("negative sequence")
+		}
+		if !checker.CheckSequence(sequence) {
+			return scriptError("relative lock %d has not been reached", sequence)
+		}
+
+	default:
+		return scriptError("unknown opcode 0x%02x", op)
+	}
+
+	return nil
+}
+
+// checkMultiSig pops n, n public keys, m and m signatures. The signatures
+// must appear in the same order as the keys that made them.
+func (s *stackMachine) checkMultiSig(script []byte, checker SigChecker) (bool, error) {
+	n, err := s.popNumber(maxNumberSize)
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > MaxPubKeysPerMultiSig {
+		return false, scriptError("invalid public key count %d", n)
+	}
+	pubKeys := make([][]byte, n)
+	for i := range pubKeys {
+		if pubKeys[i], err = s.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := s.popNumber(maxNumberSize)
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, scriptError("invalid signature count %d of %d", m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := range sigs {
+		if sigs[i], err = s.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	// Keys and signatures were popped in reverse, so walk both from the end
+	key := len(pubKeys) - 1
+	for sig := len(sigs) - 1; sig >= 0; sig-- {
+		for key >= 0 && !checker.CheckSig(sigs[sig], pubKeys[key], script) {
+			key--
+		}
+		if key < 0 {
+			return false, nil
+		}
+		key--
+	}
+
+	return true, nil
+}
+
+// asBool interprets a stack item as a boolean. Any non-zero value is true,
+// except negative zero.
+func asBool(item []byte) bool {
+	for i, b := range item {
+		if b != 0 {
+			return !(i == len(item)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+func fromBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+
+	return nil
+}
+
+// asNumber decodes a little-endian sign-magnitude number of at most maxSize
+// bytes, the encoding Bitcoin scripts use
+func asNumber(item []byte, maxSize int) (int64, error) {
+	if len(item) > maxSize {
+		return 0, scriptError("number of %d bytes is longer than %d", len(item), maxSize)
+	}
+	if len(item) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range item {
+		n |= int64(b) << uint(8*i)
+	}
+
+	if item[len(item)-1]&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(item)-1))
+		return -n, nil
+	}
+
+	return n, nil
+}
+
+// numBytes encodes n the way asNumber decodes it, in as few bytes as possible
+func numBytes(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	var result []byte
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
@@ -0,0 +1,228 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bahadylbekov/go-blockchain/wallet"
+)
+
+// testChecker accepts "sig:" followed by the public key as the signature of
+// that key, and a spending transaction locked until lockTime with an input
+// locked for sequence
+type testChecker struct {
+	lockTime int64
+	sequence int64
+}
+
+func (c testChecker) CheckSig(sig, pubKey, subScript []byte) bool {
+	return bytes.Equal(sig, testSig(pubKey))
+}
+
+func (c testChecker) CheckLockTime(lockTime int64) bool {
+	return lockTime <= c.lockTime
+}
+
+func (c testChecker) CheckSequence(sequence int64) bool {
+	return sequence <= c.sequence
+}
+
+func testSig(pubKey []byte) []byte {
+	return append([]byte("sig:"), pubKey...)
+}
+
+var (
+	keyA = []byte("public key A")
+	keyB = []byte("public key B")
+	keyC = []byte("public key C")
+)
+
+func TestVerifyTemplates(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, SecretLength)
+	secretHash := sha256.Sum256(secret)
+	wrongSecret := bytes.Repeat([]byte{8}, SecretLength)
+	hashA, hashB := wallet.PublicKeyHash(keyA), wallet.PublicKeyHash(keyB)
+
+	multiSig, err := MultiSigScript(2, [][]byte{keyA, keyB, keyC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	htlc := HTLCScript(secretHash[:], hashA, 100, hashB)
+	nullData, err := NullDataScript([]byte("notarized"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := testChecker{lockTime: 100, sequence: 10}
+
+	tests := []struct {
+		name      string
+		unlocking []byte
+		locking   []byte
+		checker   testChecker
+		valid     bool
+	}{
+		{"pubkeyhash", UnlockPubKeyHash(testSig(keyA), keyA), PayToPubKeyHash(hashA), checker, true},
+		{"pubkeyhash with another key", UnlockPubKeyHash(testSig(keyB), keyB), PayToPubKeyHash(hashA), checker, false},
+		{"pubkeyhash with a bad signature", UnlockPubKeyHash(testSig(keyB), keyA), PayToPubKeyHash(hashA), checker, false},
+
+		{"multisig", UnlockMultiSig([][]byte{testSig(keyA), testSig(keyC)}), multiSig, checker, true},
+		{"multisig out of order", UnlockMultiSig([][]byte{testSig(keyC), testSig(keyA)}), multiSig, checker, false},
+		{"multisig short of signatures", UnlockMultiSig([][]byte{testSig(keyA)}), multiSig, checker, false},
+
+		{"scripthash", UnlockScriptHash(UnlockMultiSig([][]byte{testSig(keyA), testSig(keyB)}), multiSig),
+			PayToScriptHash(wallet.PublicKeyHash(multiSig)), checker, true},
+		{"scripthash with another redeem script", UnlockScriptHash(UnlockPubKeyHash(testSig(keyA), keyA), PayToPubKeyHash(hashA)),
+			PayToScriptHash(wallet.PublicKeyHash(multiSig)), checker, false},
+		{"scripthash failing its redeem script", UnlockScriptHash(UnlockMultiSig([][]byte{testSig(keyA), testSig(keyA)}), multiSig),
+			PayToScriptHash(wallet.PublicKeyHash(multiSig)), checker, false},
+
+		{"hashlock", UnlockHashLock(testSig(keyA), keyA, secret), HashLockScript(secretHash[:], hashA), checker, true},
+		{"hashlock with a wrong preimage", UnlockHashLock(testSig(keyA), keyA, wrongSecret), HashLockScript(secretHash[:], hashA), checker, false},
+
+		{"timelock", UnlockPubKeyHash(testSig(keyA), keyA), TimeLockScript(100, hashA), checker, true},
+		{"timelock not reached", UnlockPubKeyHash(testSig(keyA), keyA), TimeLockScript(101, hashA), checker, false},
+
+		{"sequencelock", UnlockPubKeyHash(testSig(keyA), keyA), SequenceLockScript(10, hashA), checker, true},
+		{"sequencelock not reached", UnlockPubKeyHash(testSig(keyA), keyA), SequenceLockScript(11, hashA), checker, false},
+
+		{"htlc redeem", UnlockHTLCRedeem(testSig(keyA), keyA, secret), htlc, testChecker{}, true},
+		{"htlc redeem with a wrong secret", UnlockHTLCRedeem(testSig(keyA), keyA, wrongSecret), htlc, testChecker{}, false},
+		{"htlc redeem by the refund key", UnlockHTLCRedeem(testSig(keyB), keyB, secret), htlc, testChecker{}, false},
+		{"htlc refund", UnlockHTLCRefund(testSig(keyB), keyB), htlc, checker, true},
+		{"htlc refund before the lock time", UnlockHTLCRefund(testSig(keyB), keyB), htlc, testChecker{lockTime: 99}, false},
+
+		{"nulldata", NewBuilder().AddInt64(1).Script(), nullData, checker, false},
+
+		{"unlocking script with an opcode", NewBuilder().AddData(testSig(keyA)).AddData(keyA).AddOp(OP_NOP).Script(),
+			PayToPubKeyHash(hashA), checker, false},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.unlocking, tt.locking, tt.checker)
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrScriptFailed) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrScriptFailed)
+		}
+	}
+}
+
+func TestVerifyLimits(t *testing.T) {
+	repeat := func(op byte, n int) []byte {
+		return bytes.Repeat([]byte{op}, n)
+	}
+
+	tests := []struct {
+		name    string
+		locking []byte
+		reason  string
+	}{
+		{"script size", append(repeat(OP_NOP, MaxScriptSize), OP_1), "bytes, more than"},
+		{"element size", NewBuilder().AddData(make([]byte, MaxElementSize+1)).Script(), "larger than"},
+		{"stack size", repeat(OP_1, MaxStackSize+1), "stack holds more than"},
+		{"operations", append(repeat(OP_NOP, MaxOpsPerScript+1), OP_1), "operations"},
+		{"multisig keys", NewBuilder().AddInt64(0).AddData(numBytes(MaxPubKeysPerMultiSig + 1)).
+			AddOp(OP_CHECKMULTISIG).Script(), "public key count"},
+	}
+	for _, tt := range tests {
+		err := Verify(nil, tt.locking, testChecker{})
+		if !errors.Is(err, ErrScriptFailed) || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: got %v, want a failure about %q", tt.name, err, tt.reason)
+		}
+	}
+
+	// Right at the limits the same scripts run
+	atLimits := [][]byte{
+		NewBuilder().AddData(bytes.Repeat([]byte{1}, MaxElementSize)).Script(),
+		repeat(OP_1, MaxStackSize),
+		append(repeat(OP_NOP, MaxOpsPerScript), OP_1),
+	}
+	for _, locking := range atLimits {
+		if err := Verify(nil, locking, testChecker{}); err != nil {
+			t.Errorf("script of %d bytes at the limits: %v", len(locking), err)
+		}
+	}
+}
+
+// assemble is the inverse of Disassemble for scripts using minimal pushes
+func assemble(t *testing.T, text string) []byte {
+	t.Helper()
+
+	names := make(map[string]byte)
+	for op, name := range opcodeNames {
+		names[name] = op
+	}
+
+	b := NewBuilder()
+	for _, part := range strings.Fields(text) {
+		if op, ok := names[part]; ok {
+			b.AddOp(op)
+			continue
+		}
+		var n int64
+		if _, err := fmt.Sscanf(part, "OP_%d", &n); err == nil {
+			b.AddInt64(n)
+			continue
+		}
+		data, err := hex.DecodeString(part)
+		if err != nil {
+			t.Fatalf("cannot assemble %q", part)
+		}
+		b.AddData(data)
+	}
+
+	return b.Script()
+}
+
+func TestDisassemble(t *testing.T) {
+	secretHash := sha256.Sum256([]byte("secret"))
+	hashA := wallet.PublicKeyHash(keyA)
+	multiSig, err := MultiSigScript(2, [][]byte{keyA, keyB, keyC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nullData, err := NullDataScript(make([]byte, MaxDataCarrierSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Disassemble(PayToPubKeyHash(hashA))
+	want := "OP_DUP OP_HASH160 " + hex.EncodeToString(hashA) + " OP_EQUALVERIFY OP_CHECKSIG"
+	if err != nil || got != want {
+		t.Errorf("Disassemble = %q, %v; want %q", got, err, want)
+	}
+
+	scripts := [][]byte{
+		PayToPubKeyHash(hashA),
+		PayToScriptHash(hashA),
+		multiSig,
+		HashLockScript(secretHash[:], hashA),
+		TimeLockScript(500000, hashA),
+		SequenceLockScript(144, hashA),
+		HTLCScript(secretHash[:], hashA, 1562889600, wallet.PublicKeyHash(keyB)),
+		nullData,
+		NewBuilder().AddInt64(-1).AddInt64(0).AddData(make([]byte, 300)).Script(),
+	}
+	for _, s := range scripts {
+		text, err := Disassemble(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again := assemble(t, text); !bytes.Equal(again, s) {
+			t.Errorf("%q assembles to %x, want %x", text, again, s)
+		}
+	}
+
+	truncated := PayToPubKeyHash(hashA)[:10]
+	if _, err := Disassemble(truncated); !errors.Is(err, ErrScriptFailed) {
+		t.Errorf("truncated script: got %v, want %v", err, ErrScriptFailed)
+	}
+	if text := DisassembleString(truncated); text != "[invalid] "+hex.EncodeToString(truncated) {
+		t.Errorf("DisassembleString = %q", text)
+	}
+}
@@ -0,0 +1,332 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Class identifies a standard locking script template
+type Class int
+
+const (
+	NonStandard Class = iota
+	PubKeyHash
+	ScriptHash
+	MultiSig
+	HashLock
+	TimeLock
+	SequenceLock
+	HTLC
+	NullData
+)
+
+var classNames = map[Class]string{
+	NonStandard:  "nonstandard",
+	PubKeyHash:   "pubkeyhash",
+	ScriptHash:   "scripthash",
+	MultiSig:     "multisig",
+	HashLock:     "hashlock",
+	TimeLock:     "timelock",
+	SequenceLock: "sequencelock",
+	HTLC:         "htlc",
+	NullData:     "nulldata",
+}
+
+func (c Class) String() string {
+	return classNames[c]
+}
+
+// MaxDataCarrierSize is the most data a null data script may carry
+const MaxDataCarrierSize = 80
+
+// SecretLength is the length of the secrets of hash time-locked contracts
+const SecretLength = 32
+
+// hashLength is the length of the HASH160 digests used by pay-to-pubkey-hash
+// and pay-to-script-hash
+const hashLength = 20
+
+// PayToPubKeyHash returns a script that is unlocked by a public key hashing
+// to pubKeyHash and a signature by that key:
+// OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func PayToPubKeyHash(pubKeyHash []byte) []byte {
+	return NewBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// PayToScriptHash returns a script that is unlocked by a redeem script hashing
+// to scriptHash together with the data that unlocks the redeem script:
+// OP_HASH160 <scriptHash> OP_EQUAL
+func PayToScriptHash(scriptHash []byte) []byte {
+	return NewBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// MultiSigScript returns a script that is unlocked by signatures of required
+// of the given public keys, in the order of the keys:
+// OP_m <pubKey>... OP_n OP_CHECKMULTISIG
+func MultiSigScript(required int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > 16 || required < 1 || required > len(pubKeys) {
+		return nil, fmt.Errorf("invalid multisig of %d of %d keys", required, len(pubKeys))
+	}
+
+	b := NewBuilder().AddInt64(int64(required))
+	for _, pubKey := range pubKeys {
+		b.AddData(pubKey)
+	}
+
+	return b.AddInt64(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// HashLockScript returns a script that is unlocked by the SHA-256 preimage of
+// hash together with a signature by the key of pubKeyHash:
+// OP_SHA256 <hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func HashLockScript(hash, pubKeyHash []byte) []byte {
+	return NewBuilder().AddOp(OP_SHA256).AddData(hash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).Script()
+}
+
+// TimeLockScript returns a pay-to-pubkey-hash script that can only be spent by
+// a transaction whose lock time is at least lockTime:
+// <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func TimeLockScript(lockTime int64, pubKeyHash []byte) []byte {
+	return NewBuilder().AddInt64(lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).Script()
+}
+
+// SequenceLockScript returns a pay-to-pubkey-hash script that can only be
+// spent by an input whose relative lock is at least sequence:
+// <sequence> OP_CHECKSEQUENCEVERIFY OP_DROP OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func SequenceLockScript(sequence int64, pubKeyHash []byte) []byte {
+	return NewBuilder().AddInt64(sequence).AddOp(OP_CHECKSEQUENCEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).Script()
+}
+
+// HTLCScript returns a hash time-locked contract. The key of recipient can
+// spend it with the SHA-256 preimage of secretHash, and the key of refund can
+// once the lock time of the spending transaction is at least lockTime:
+//
+//	OP_IF
+//	    OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <secretHash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient>
+//	OP_ELSE
+//	    <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refund>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+func HTLCScript(secretHash, recipient []byte, lockTime int64, refund []byte) []byte {
+	return NewBuilder().AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt64(SecretLength).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(secretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(recipient).
+		AddOp(OP_ELSE).
+		AddInt64(lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(refund).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// NullDataScript returns a script that carries data and can never be
+// unlocked: OP_RETURN <data>
+func NullDataScript(data []byte) ([]byte, error) {
+	if len(data) > MaxDataCarrierSize {
+		return nil, fmt.Errorf("data of %d bytes exceeds the limit of %d", len(data), MaxDataCarrierSize)
+	}
+
+	return NewBuilder().AddOp(OP_RETURN).AddData(data).Script(), nil
+}
+
+// IsUnspendable reports whether script fails whatever unlocks it, because
+// it starts with OP_RETURN
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN
+}
+
+// ExtractNullData returns the data carried by a null data script
+func ExtractNullData(script []byte) ([]byte, bool) {
+	instructions, err := parse(script)
+	if err != nil || len(instructions) != 2 || instructions[0].op != OP_RETURN ||
+		instructions[1].op > OP_PUSHDATA2 {
+		return nil, false
+	}
+
+	data := instructions[1].pushed()
+	if len(data) > MaxDataCarrierSize {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// IsPayToScriptHash reports whether script is a pay-to-script-hash script
+func IsPayToScriptHash(script []byte) bool {
+	return len(script) == hashLength+3 && script[0] == OP_HASH160 &&
+		script[1] == hashLength && script[hashLength+2] == OP_EQUAL
+}
+
+// ExtractPubKeyHash returns the key hash of a pay-to-pubkey-hash script, or
+// nil for any other script
+func ExtractPubKeyHash(script []byte) []byte {
+	if len(script) == hashLength+5 && script[0] == OP_DUP && script[1] == OP_HASH160 &&
+		script[2] == hashLength && script[hashLength+3] == OP_EQUALVERIFY &&
+		script[hashLength+4] == OP_CHECKSIG {
+		return script[3 : hashLength+3]
+	}
+
+	return nil
+}
+
+// ExtractScriptHash returns the script hash of a pay-to-script-hash script,
+// or nil for any other script
+func ExtractScriptHash(script []byte) []byte {
+	if IsPayToScriptHash(script) {
+		return script[2 : hashLength+2]
+	}
+
+	return nil
+}
+
+// ExtractMultiSig returns the number of required signatures and the public
+// keys of a multisig script
+func ExtractMultiSig(script []byte) (int, [][]byte, bool) {
+	instructions, err := parse(script)
+	if err != nil || len(instructions) < 4 {
+		return 0, nil, false
+	}
+
+	first, last := instructions[0], instructions[len(instructions)-2]
+	if instructions[len(instructions)-1].op != OP_CHECKMULTISIG ||
+		first.op < OP_1 || first.op > OP_16 || last.op < OP_1 || last.op > OP_16 {
+		return 0, nil, false
+	}
+
+	required := int(first.op - OP_1 + 1)
+	var pubKeys [][]byte
+	for _, ins := range instructions[1 : len(instructions)-2] {
+		if ins.op == OP_0 || ins.op > OP_PUSHDATA2 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, ins.data)
+	}
+	if len(pubKeys) != int(last.op-OP_1+1) || required > len(pubKeys) {
+		return 0, nil, false
+	}
+
+	return required, pubKeys, true
+}
+
+// ExtractTimeLock returns the lock time and key hash of a time-lock script
+func ExtractTimeLock(script []byte) (int64, []byte, bool) {
+	return extractLock(script, OP_CHECKLOCKTIMEVERIFY, TimeLockScript)
+}
+
+// ExtractSequenceLock returns the relative lock and key hash of a
+// sequence-lock script
+func ExtractSequenceLock(script []byte) (int64, []byte, bool) {
+	return extractLock(script, OP_CHECKSEQUENCEVERIFY, SequenceLockScript)
+}
+
+// extractLock matches script against a lock template built by build around
+// the opcode op
+func extractLock(script []byte, op byte, build func(int64, []byte) []byte) (int64, []byte, bool) {
+	instructions, err := parse(script)
+	if err != nil || len(instructions) != 8 || instructions[1].op != op {
+		return 0, nil, false
+	}
+
+	lock, err := asNumber(instructions[0].pushed(), maxLockTimeSize)
+	if err != nil || !bytes.Equal(build(lock, instructions[5].data), script) {
+		return 0, nil, false
+	}
+
+	return lock, instructions[5].data, true
+}
+
+// ExtractHTLC returns the secret hash, recipient key hash, lock time and
+// refund key hash of a hash time-locked contract
+func ExtractHTLC(script []byte) (secretHash, recipient []byte, lockTime int64, refund []byte, ok bool) {
+	instructions, err := parse(script)
+	if err != nil || len(instructions) != 20 {
+		return nil, nil, 0, nil, false
+	}
+
+	secretHash, recipient, refund = instructions[5].data, instructions[9].data, instructions[16].data
+	lockTime, err = asNumber(instructions[11].pushed(), maxLockTimeSize)
+	if err != nil || !bytes.Equal(HTLCScript(secretHash, recipient, lockTime, refund), script) {
+		return nil, nil, 0, nil, false
+	}
+
+	return secretHash, recipient, lockTime, refund, true
+}
+
+// Classify returns the standard template script follows
+func Classify(script []byte) Class {
+	switch {
+	case ExtractPubKeyHash(script) != nil:
+		return PubKeyHash
+	case IsPayToScriptHash(script):
+		return ScriptHash
+	}
+	if _, _, ok := ExtractMultiSig(script); ok {
+		return MultiSig
+	}
+	if _, _, ok := ExtractTimeLock(script); ok {
+		return TimeLock
+	}
+	if _, _, ok := ExtractSequenceLock(script); ok {
+		return SequenceLock
+	}
+	if _, _, _, _, ok := ExtractHTLC(script); ok {
+		return HTLC
+	}
+	if _, ok := ExtractNullData(script); ok {
+		return NullData
+	}
+
+	instructions, err := parse(script)
+	if err == nil && len(instructions) == 8 && instructions[0].op == OP_SHA256 &&
+		bytes.Equal(HashLockScript(instructions[1].data, instructions[5].data), script) {
+		return HashLock
+	}
+
+	return NonStandard
+}
+
+// UnlockPubKeyHash returns the unlocking script of a pay-to-pubkey-hash output
+func UnlockPubKeyHash(sig, pubKey []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).Script()
+}
+
+// UnlockMultiSig returns the unlocking script of a multisig script, with the
+// signatures in the order of the keys that made them
+func UnlockMultiSig(sigs [][]byte) []byte {
+	b := NewBuilder()
+	for _, sig := range sigs {
+		b.AddData(sig)
+	}
+
+	return b.Script()
+}
+
+// UnlockHashLock returns the unlocking script of a hash-lock script
+func UnlockHashLock(sig, pubKey, preimage []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddData(preimage).Script()
+}
+
+// UnlockHTLCRedeem returns the unlocking script taking the recipient branch
+// of a hash time-locked contract
+func UnlockHTLCRedeem(sig, pubKey, secret []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddData(secret).AddInt64(1).Script()
+}
+
+// UnlockHTLCRefund returns the unlocking script taking the refund branch of a
+// hash time-locked contract
+func UnlockHTLCRefund(sig, pubKey []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddInt64(0).Script()
+}
+
+// UnlockScriptHash appends the redeem script to the unlocking script of the
+// redeem script, giving the unlocking script of a pay-to-script-hash output
+func UnlockScriptHash(unlocking, redeemScript []byte) []byte {
+	return append(append([]byte{}, unlocking...), NewBuilder().AddData(redeemScript).Script()...)
+}
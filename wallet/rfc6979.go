@@ -0,0 +1,92 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+)
+
+// signRFC6979 signs hash with a nonce derived from the private key and the
+// hash as described in RFC 6979 section 3.2, using HMAC-SHA256. Signing the
+// same hash with the same key always gives the same signature.
+func signRFC6979(privKey *ecdsa.PrivateKey, hash []byte) (r, s *big.Int) {
+	curve := privKey.Curve
+	n := curve.Params().N
+	qlen := n.BitLen()
+	rolen := (qlen + 7) / 8
+
+	e := bits2int(hash, qlen)
+	x := int2octets(privKey.D, rolen)
+	h1 := int2octets(new(big.Int).Mod(e, n), rolen)
+
+	v := make([]byte, sha256.Size)
+	for i := range v {
+		v[i] = 0x01
+	}
+	k := make([]byte, sha256.Size)
+
+	k = mac(k, v, []byte{0x00}, x, h1)
+	v = mac(k, v)
+	k = mac(k, v, []byte{0x01}, x, h1)
+	v = mac(k, v)
+
+	for {
+		var t []byte
+		for len(t) < rolen {
+			v = mac(k, v)
+			t = append(t, v...)
+		}
+
+		nonce := bits2int(t[:rolen], qlen)
+		if nonce.Sign() > 0 && nonce.Cmp(n) < 0 {
+			rx, _ := curve.ScalarBaseMult(int2octets(nonce, rolen))
+			r = rx.Mod(rx, n)
+			if r.Sign() != 0 {
+				s = new(big.Int).Mul(r, privKey.D)
+				s.Add(s, e)
+				s.Mul(s, new(big.Int).ModInverse(nonce, n))
+				s.Mod(s, n)
+				if s.Sign() != 0 {
+					return r, s
+				}
+			}
+		}
+
+		k = mac(k, v, []byte{0x00})
+		v = mac(k, v)
+	}
+}
+
+// mac returns HMAC-SHA256 under key of the concatenated data
+func mac(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+// bits2int converts b to an integer keeping its leftmost qlen bits
+func bits2int(b []byte, qlen int) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if blen := len(b) * 8; blen > qlen {
+		v.Rsh(v, uint(blen-qlen))
+	}
+
+	return v
+}
+
+// int2octets returns v as a big-endian byte slice of length rolen
+func int2octets(v *big.Int, rolen int) []byte {
+	b := v.Bytes()
+	if len(b) >= rolen {
+		return b[len(b)-rolen:]
+	}
+
+	out := make([]byte, rolen)
+	copy(out[rolen-len(b):], b)
+
+	return out
+}
@@ -0,0 +1,108 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func hexInt(t *testing.T, s string) *big.Int {
+	t.Helper()
+
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("bad hex number %s", s)
+	}
+
+	return n
+}
+
+// TestRFC6979Vectors checks the P-256 signatures with SHA-256 of RFC 6979
+// appendix A.2.5
+func TestRFC6979Vectors(t *testing.T) {
+	curve := elliptic.P256()
+	private := ecdsa.PrivateKey{D: hexInt(t, "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(private.D.Bytes())
+
+	pub := EncodePublicKey(&private.PublicKey)
+	wantPub := "60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6" +
+		"7903FE1008B8BC99A41AE9E95628BC64F2F1B20C2D7E9F5177A3C294D4462299"
+	if !bytes.Equal(pub, mustHex(t, wantPub)) {
+		t.Fatalf("public key = %X, want %s", pub, wantPub)
+	}
+
+	tests := []struct {
+		message string
+		r, s    string
+	}{
+		{
+			"sample",
+			"EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+			"F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8",
+		},
+		{
+			"test",
+			"F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367",
+			"019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083",
+		},
+	}
+	for _, tt := range tests {
+		hash := sha256.Sum256([]byte(tt.message))
+		wantR, wantS := hexInt(t, tt.r), hexInt(t, tt.s)
+
+		r, s := signRFC6979(&private, hash[:])
+		if r.Cmp(wantR) != 0 || s.Cmp(wantS) != 0 {
+			t.Errorf("%q: signature = (%X, %X), want (%X, %X)", tt.message, r, s, wantR, wantS)
+		}
+
+		// Sign encodes the same signature with s in the lower half
+		n := curve.Params().N
+		if wantS.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			wantS.Sub(n, wantS)
+		}
+		want := paddedAppend(paddedAppend(nil, wantR), wantS)
+		signature, err := Sign(&private, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(signature, want) {
+			t.Errorf("%q: Sign = %x, want %x", tt.message, signature, want)
+		}
+		if !Verify(pub, hash[:], signature) {
+			t.Errorf("%q: signature does not verify", tt.message)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestSignDeterministic(t *testing.T) {
+	w := CreateWallet()
+	hash := sha256.Sum256([]byte("pay 20 to bob"))
+
+	first, err := Sign(&w.PrivateKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Sign(&w.PrivateKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("signatures differ: %x and %x", first, second)
+	}
+}
@@ -0,0 +1,113 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+const (
+	// coordinateLength is the width of a P256 scalar or coordinate
+	coordinateLength = 32
+	// SignatureLength is the width of an encoded signature, r followed by s
+	SignatureLength = 2 * coordinateLength
+	// PublicKeyLength is the width of an encoded public key, X followed by Y
+	PublicKeyLength = 2 * coordinateLength
+
+	messagePrefix = "go-blockchain signed message:\n"
+)
+
+var (
+	ErrInvalidPublicKey  = errors.New("invalid public key")
+	ErrInvalidPrivateKey = errors.New("invalid private key")
+)
+
+// paddedAppend appends n to buf, left-padded with zeros to coordinateLength
+func paddedAppend(buf []byte, n *big.Int) []byte {
+	b := n.Bytes()
+	for i := len(b); i < coordinateLength; i++ {
+		buf = append(buf, 0)
+	}
+
+	return append(buf, b...)
+}
+
+// EncodePublicKey returns the fixed-width X||Y encoding of pub
+func EncodePublicKey(pub *ecdsa.PublicKey) []byte {
+	buf := make([]byte, 0, PublicKeyLength)
+	buf = paddedAppend(buf, pub.X)
+
+	return paddedAppend(buf, pub.Y)
+}
+
+// ParsePublicKey decodes an X||Y public key and checks it lies on the curve
+func ParsePublicKey(pubKey []byte) (*ecdsa.PublicKey, error) {
+	if len(pubKey) != PublicKeyLength {
+		return nil, ErrInvalidPublicKey
+	}
+
+	curve := elliptic.P256()
+	x := new(big.Int).SetBytes(pubKey[:coordinateLength])
+	y := new(big.Int).SetBytes(pubKey[coordinateLength:])
+	if !curve.IsOnCurve(x, y) {
+		return nil, ErrInvalidPublicKey
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// Sign signs hash with privKey using a deterministic RFC 6979 nonce. The
+// signature is encoded as fixed-width r||s with s normalized to the lower
+// half of the curve order, so every valid signature has exactly one encoding.
+func Sign(privKey *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	if privKey.D == nil || privKey.D.Sign() <= 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	r, s := signRFC6979(privKey, hash)
+
+	n := privKey.Curve.Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+
+	signature := make([]byte, 0, SignatureLength)
+	signature = paddedAppend(signature, r)
+
+	return paddedAppend(signature, s), nil
+}
+
+// Verify checks a signature made by Sign. Signatures with a high s value are
+// rejected.
+func Verify(pubKey, hash, signature []byte) bool {
+	pub, err := ParsePublicKey(pubKey)
+	if err != nil || len(signature) != SignatureLength {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:coordinateLength])
+	s := new(big.Int).SetBytes(signature[coordinateLength:])
+	if s.Cmp(new(big.Int).Rsh(pub.Curve.Params().N, 1)) > 0 {
+		return false
+	}
+
+	return ecdsa.Verify(pub, hash, r, s)
+}
+
+// SignMessage signs an arbitrary message. The message is hashed with a prefix
+// so a message signature can never be replayed as a transaction signature.
+func SignMessage(privKey *ecdsa.PrivateKey, message []byte) ([]byte, error) {
+	return Sign(privKey, messageHash(message))
+}
+
+// VerifyMessage checks a signature made by SignMessage
+func VerifyMessage(pubKey, message, signature []byte) bool {
+	return Verify(pubKey, messageHash(message), signature)
+}
+
+func messageHash(message []byte) []byte {
+	hash := sha256.Sum256(append([]byte(messagePrefix), message...))
+
+	return hash[:]
+}
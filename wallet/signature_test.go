@@ -0,0 +1,65 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+// highS returns signature with s replaced by n - s, the other valid form
+func highS(signature []byte) []byte {
+	n := elliptic.P256().Params().N
+	s := new(big.Int).SetBytes(signature[coordinateLength:])
+
+	out := append([]byte{}, signature[:coordinateLength]...)
+	return paddedAppend(out, s.Sub(n, s))
+}
+
+func TestSignVerify(t *testing.T) {
+	signer, other := CreateWallet(), CreateWallet()
+	hash := sha256.Sum256([]byte("pay 20 to bob"))
+	signature, err := Sign(&signer.PrivateKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The high s form is a valid ECDSA signature that only the low s rule
+	// rejects
+	r := new(big.Int).SetBytes(signature[:coordinateLength])
+	s := new(big.Int).SetBytes(highS(signature)[coordinateLength:])
+	if !ecdsa.Verify(&signer.PrivateKey.PublicKey, hash[:], r, s) {
+		t.Fatal("high s form does not verify as plain ECDSA")
+	}
+
+	tests := []struct {
+		name      string
+		pubKey    []byte
+		hash      []byte
+		signature []byte
+		want      bool
+	}{
+		{"valid", signer.PublicKey, hash[:], signature, true},
+		{"tampered hash", signer.PublicKey, flipByte(hash[:], 0), signature, false},
+		{"flipped r byte", signer.PublicKey, hash[:], flipByte(signature, 5), false},
+		{"flipped s byte", signer.PublicKey, hash[:], flipByte(signature, SignatureLength-1), false},
+		{"high s", signer.PublicKey, hash[:], highS(signature), false},
+		{"truncated", signer.PublicKey, hash[:], signature[:SignatureLength-1], false},
+		{"wrong key", other.PublicKey, hash[:], signature, false},
+		{"malformed key", signer.PublicKey[1:], hash[:], signature, false},
+	}
+	for _, tt := range tests {
+		if got := Verify(tt.pubKey, tt.hash, tt.signature); got != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// flipByte returns a copy of b with the bits of byte i inverted
+func flipByte(b []byte, i int) []byte {
+	out := append([]byte{}, b...)
+	out[i] ^= 0xff
+
+	return out
+}
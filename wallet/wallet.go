@@ -6,25 +6,66 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
 	"log"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	checksumLength = 4
-	version        = byte(0x00)
-)
+const checksumLength = 4
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
 }
 
-func (w Wallet) Address() []byte {
-	pubKeyHash := PublicKeyHash(w.PublicKey)
+// walletData is the on-disk form of a Wallet. The curve is always P256, so
+// only the private scalar and the public key are stored.
+type walletData struct {
+	D         []byte
+	PublicKey []byte
+}
+
+func (w Wallet) GobEncode() ([]byte, error) {
+	var content bytes.Buffer
+
+	data := walletData{w.PrivateKey.D.Bytes(), w.PublicKey}
+	err := gob.NewEncoder(&content).Encode(data)
+
+	return content.Bytes(), err
+}
+
+func (w *Wallet) GobDecode(content []byte) error {
+	var data walletData
+
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&data); err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(data.D)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(data.D)
+
+	w.PrivateKey = private
+	w.PublicKey = data.PublicKey
+	return nil
+}
+
+func (w Wallet) Address(version byte) []byte {
+	return EncodeAddress(PublicKeyHash(w.PublicKey), version)
+}
+
+// ScriptAddress returns the address of the hash of a redeem script, to be
+// encoded with the script address version of the network
+func ScriptAddress(redeemScript []byte, version byte) []byte {
+	return EncodeAddress(PublicKeyHash(redeemScript), version)
+}
 
-	versionHash := append([]byte{version}, pubKeyHash...)
+// EncodeAddress returns the Base58Check address of hash with the given version
+func EncodeAddress(hash []byte, version byte) []byte {
+	versionHash := append([]byte{version}, hash...)
 	checksum := Checksum(versionHash)
 
 	fullHash := append(versionHash, checksum...)
@@ -33,6 +74,17 @@ func (w Wallet) Address() []byte {
 	return address
 }
 
+// AddressHash returns the hash encoded by a valid address, without its
+// version and checksum, or nil if address is too short to hold one
+func AddressHash(address string) []byte {
+	hash := Base58Decode([]byte(address))
+	if len(hash) <= 1+checksumLength {
+		return nil
+	}
+
+	return hash[1 : len(hash)-checksumLength]
+}
+
 func HandleErr(err error) {
 	if err != nil {
 		log.Panic(err)
@@ -45,7 +97,7 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	HandleErr(err)
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pub := EncodePublicKey(&private.PublicKey)
 
 	return *private, pub
 }
@@ -76,10 +128,12 @@ func Checksum(payload []byte) []byte {
 	return secondHash[:checksumLength]
 }
 
-func ValidateAddress(address string) bool {
+func ValidateAddress(address string, version byte) bool {
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= 1+checksumLength || pubKeyHash[0] != version {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
 
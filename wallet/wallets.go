@@ -2,31 +2,40 @@ package wallet
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
+
+	"github.com/bahadylbekov/go-blockchain/chaincfg"
 )
 
-const walletFile = "./tmp/wallet.data"
+const walletFile = "wallet.data"
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	params *chaincfg.ChainParams
 }
 
-func CreateWallets() (*Wallets, error) {
+func CreateWallets(params *chaincfg.ChainParams) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.params = params
 
 	err := wallets.LoadFile()
 
 	return &wallets, err
 }
 
-func (ws *Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	w, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("no wallet for address %s", address)
+	}
+
+	return *w, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -42,43 +51,45 @@ func (ws *Wallets) GetAllAddresses() []string {
 func (ws *Wallets) AddWallet() string {
 	newWallet := CreateWallet()
 
-	address := fmt.Sprintf("%s", newWallet.Address())
+	address := fmt.Sprintf("%s", newWallet.Address(ws.params.AddressVersion))
 	ws.Wallets[address] = newWallet
 	return address
 }
 
-func (ws *Wallets) SaveFile() {
-	var content bytes.Buffer
+func (ws *Wallets) path() string {
+	return filepath.Join(ws.params.DataDir, walletFile)
+}
 
-	gob.Register(elliptic.P256())
+func (ws *Wallets) SaveFile() error {
+	var content bytes.Buffer
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
-	if err != nil {
-		log.Panic(err)
+	if err := encoder.Encode(ws); err != nil {
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
+	if err := os.MkdirAll(ws.params.DataDir, 0755); err != nil {
+		return err
 	}
+
+	return ioutil.WriteFile(ws.path(), content.Bytes(), 0600)
 }
 
+// LoadFile reads wallets from the data directory. A missing file is not an
+// error, it just means no wallets were created yet.
 func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	fileContent, err := ioutil.ReadFile(ws.path())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
 	var wallets Wallets
 
-	fileContent, err := ioutil.ReadFile(walletFile)
-
-	gob.Register(elliptic.P256())
-
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
-	if err != nil {
-		log.Panic(err)
+	if err := decoder.Decode(&wallets); err != nil {
+		return err
 	}
 
 	ws.Wallets = wallets.Wallets